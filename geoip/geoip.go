@@ -0,0 +1,326 @@
+// Package geoip reads MaxMind DB (MMDB) files, like GeoLite2 Country, to find
+// country and continent of IP addresses.
+package geoip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"strings"
+)
+
+var metadata_marker = []byte("\xab\xcd\xefMaxMind.com")
+
+// Data section starts after search tree and 16 zero bytes.
+const data_separator = 16
+
+// Types of data fields.
+const (
+	typeExtended = iota
+	typePointer
+	typeString
+	typeDouble
+	typeBytes
+	typeUint16
+	typeUint32
+	typeMap
+	typeInt32
+	typeUint64
+	typeUint128
+	typeArray
+	typeContainer
+	typeEndMarker
+	typeBool
+	typeFloat
+)
+
+type Metadata struct {
+	NodeCount    uint
+	RecordSize   uint
+	IPVersion    uint
+	DatabaseType string
+	BuildEpoch   uint64
+}
+
+type Reader struct {
+	Metadata Metadata
+	buffer   []byte
+	tree     []byte
+	data     []byte
+	// Node of ::/96 in IPv6 trees, where IPv4 addresses are looked up.
+	ipv4_start uint
+}
+
+// Open reads whole database in memory.
+func Open(file string) (reader *Reader, err error) {
+	buffer, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return FromBytes(buffer)
+}
+
+func FromBytes(buffer []byte) (reader *Reader, err error) {
+	idx := bytes.LastIndex(buffer, metadata_marker)
+	if idx == -1 {
+		return nil, errors.New("invalid mmdb: metadata not found")
+	}
+	meta := buffer[idx+len(metadata_marker):]
+	value, _, err := decode(meta, 0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("invalid mmdb metadata: %s", err.Error())
+	}
+	fields, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("invalid mmdb metadata: not a map")
+	}
+	reader = &Reader{buffer: buffer}
+	reader.Metadata.NodeCount = uint(toUint(fields["node_count"]))
+	reader.Metadata.RecordSize = uint(toUint(fields["record_size"]))
+	reader.Metadata.IPVersion = uint(toUint(fields["ip_version"]))
+	reader.Metadata.BuildEpoch = toUint(fields["build_epoch"])
+	reader.Metadata.DatabaseType, _ = fields["database_type"].(string)
+	switch reader.Metadata.RecordSize {
+	case 24, 28, 32:
+	default:
+		return nil, fmt.Errorf("invalid mmdb: unsupported record size %d", reader.Metadata.RecordSize)
+	}
+	if reader.Metadata.IPVersion != 4 && reader.Metadata.IPVersion != 6 {
+		return nil, fmt.Errorf("invalid mmdb: unsupported ip version %d", reader.Metadata.IPVersion)
+	}
+	tree_size := reader.Metadata.NodeCount * reader.Metadata.RecordSize / 4
+	if tree_size+data_separator > uint(idx) {
+		return nil, errors.New("invalid mmdb: search tree out of bound")
+	}
+	reader.tree = buffer[:tree_size]
+	reader.data = buffer[tree_size+data_separator : idx]
+	if reader.Metadata.IPVersion == 6 {
+		node := uint(0)
+		for i := 0; i < 96 && node < reader.Metadata.NodeCount; i++ {
+			node = reader.record(node, 0)
+		}
+		reader.ipv4_start = node
+	}
+	return reader, nil
+}
+
+func toUint(value interface{}) uint64 {
+	switch v := value.(type) {
+	case uint64:
+		return v
+	case uint32:
+		return uint64(v)
+	case uint16:
+		return uint64(v)
+	}
+	return 0
+}
+
+// record returns left (bit 0) or right (bit 1) record of node.
+func (reader *Reader) record(node uint, bit uint) uint {
+	size := reader.Metadata.RecordSize
+	b := reader.tree[node*size/4:]
+	switch size {
+	case 24:
+		b = b[bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(b[bit*4:]))
+	}
+}
+
+// Lookup returns record of ip, nil if not found.
+func (reader *Reader) Lookup(ip net.IP) (record interface{}, err error) {
+	node, bits := uint(0), 128
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, 32
+		if reader.Metadata.IPVersion == 6 {
+			node = reader.ipv4_start
+		}
+	} else if ip = ip.To16(); ip == nil {
+		return nil, errors.New("invalid ip")
+	} else if reader.Metadata.IPVersion == 4 {
+		return nil, errors.New("ipv6 lookup in ipv4 database")
+	}
+	count := reader.Metadata.NodeCount
+	for i := 0; i < bits && node < count; i++ {
+		bit := uint(ip[i>>3]>>(7-uint(i&7))) & 1
+		node = reader.record(node, bit)
+	}
+	if node == count {
+		return nil, nil
+	}
+	if node < count {
+		return nil, errors.New("invalid mmdb: search tree too deep")
+	}
+	offset := node - count - data_separator
+	if offset >= uint(len(reader.data)) {
+		return nil, errors.New("invalid mmdb: record out of bound")
+	}
+	record, _, err = decode(reader.data, offset, 0)
+	return
+}
+
+// Country returns ISO country code and continent code of ip, empty if
+// unknown. Registered country is used if country is missing.
+func (reader *Reader) Country(ip net.IP) (country, continent string, err error) {
+	record, err := reader.Lookup(ip)
+	if err != nil {
+		return "", "", err
+	}
+	fields, _ := record.(map[string]interface{})
+	country = field(fields, "country", "iso_code")
+	if country == "" {
+		country = field(fields, "registered_country", "iso_code")
+	}
+	continent = field(fields, "continent", "code")
+	return strings.ToUpper(country), strings.ToUpper(continent), nil
+}
+
+func field(fields map[string]interface{}, name, key string) string {
+	sub, _ := fields[name].(map[string]interface{})
+	val, _ := sub[key].(string)
+	return val
+}
+
+// Pointers may be nested, but not too deep, to avoid loops in bad files.
+const max_depth = 32
+
+// decode decodes field at offset of data, returns value and offset of next
+// field.
+func decode(data []byte, offset uint, depth int) (value interface{}, next uint, err error) {
+	if depth > max_depth {
+		return nil, 0, errors.New("data nested too deep")
+	}
+	read := func(n uint) ([]byte, error) {
+		if offset+n > uint(len(data)) {
+			return nil, errors.New("data out of bound")
+		}
+		b := data[offset : offset+n]
+		offset += n
+		return b, nil
+	}
+	b, err := read(1)
+	if err != nil {
+		return nil, 0, err
+	}
+	ctrl := b[0]
+	kind := uint(ctrl >> 5)
+	if kind == typePointer {
+		n := uint(ctrl>>3&3) + 1
+		if b, err = read(n); err != nil {
+			return nil, 0, err
+		}
+		var ptr uint
+		if n == 4 {
+			ptr = uint(binary.BigEndian.Uint32(b))
+		} else {
+			ptr = uint(ctrl & 7)
+			for _, c := range b {
+				ptr = ptr<<8 | uint(c)
+			}
+			ptr += [...]uint{0, 2048, 526336}[n-1]
+		}
+		value, _, err = decode(data, ptr, depth+1)
+		return value, offset, err
+	}
+	if kind == typeExtended {
+		if b, err = read(1); err != nil {
+			return nil, 0, err
+		}
+		kind = 7 + uint(b[0])
+	}
+	size := uint(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		if b, err = read(n); err != nil {
+			return nil, 0, err
+		}
+		extra := uint(0)
+		for _, c := range b {
+			extra = extra<<8 | uint(c)
+		}
+		size = [...]uint{29, 285, 65821}[n-1] + extra
+	}
+	switch kind {
+	case typeMap:
+		m := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			var key, val interface{}
+			if key, offset, err = decode(data, offset, depth+1); err != nil {
+				return nil, 0, err
+			}
+			name, ok := key.(string)
+			if !ok {
+				return nil, 0, errors.New("map key is not a string")
+			}
+			if val, offset, err = decode(data, offset, depth+1); err != nil {
+				return nil, 0, err
+			}
+			m[name] = val
+		}
+		return m, offset, nil
+	case typeArray:
+		a := make([]interface{}, 0, size)
+		for i := uint(0); i < size; i++ {
+			var val interface{}
+			if val, offset, err = decode(data, offset, depth+1); err != nil {
+				return nil, 0, err
+			}
+			a = append(a, val)
+		}
+		return a, offset, nil
+	case typeBool:
+		return size != 0, offset, nil
+	case typeContainer, typeEndMarker:
+		return nil, offset, nil
+	}
+	if b, err = read(size); err != nil {
+		return nil, 0, err
+	}
+	switch kind {
+	case typeString:
+		return string(b), offset, nil
+	case typeBytes:
+		return append([]byte(nil), b...), offset, nil
+	case typeDouble:
+		if size != 8 {
+			return nil, 0, errors.New("invalid double size")
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), offset, nil
+	case typeFloat:
+		if size != 4 {
+			return nil, 0, errors.New("invalid float size")
+		}
+		return math.Float32frombits(binary.BigEndian.Uint32(b)), offset, nil
+	case typeUint16, typeUint32, typeUint64, typeInt32:
+		if size > 8 {
+			return nil, 0, errors.New("invalid integer size")
+		}
+		val := uint64(0)
+		for _, c := range b {
+			val = val<<8 | uint64(c)
+		}
+		switch kind {
+		case typeUint16:
+			return uint16(val), offset, nil
+		case typeUint32:
+			return uint32(val), offset, nil
+		case typeInt32:
+			return int32(uint32(val)), offset, nil
+		}
+		return val, offset, nil
+	case typeUint128:
+		return append([]byte(nil), b...), offset, nil
+	}
+	return nil, 0, fmt.Errorf("unknown data type %d", kind)
+}
@@ -0,0 +1,149 @@
+package geoip
+
+import (
+	"github.com/jackyyf/MineGate-Go/internal/mmdbtest"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+)
+
+func country(iso, continent string) map[string]interface{} {
+	return map[string]interface{}{
+		"continent":  map[string]interface{}{"code": continent, "geoname_id": uint32(6255148)},
+		"country":    map[string]interface{}{"iso_code": iso, "names": map[string]interface{}{"en": iso}},
+		"is_proxy":   false,
+		"confidence": uint16(99),
+	}
+}
+
+func fixture(t *testing.T, ip_version, record_size uint) *Reader {
+	writer := mmdbtest.NewWriter(ip_version)
+	networks := []struct {
+		cidr   string
+		record map[string]interface{}
+	}{
+		{"1.0.0.0/8", country("US", "NA")},
+		{"1.2.0.0/16", country("DE", "EU")},
+		{"81.0.0.0/9", country("FR", "EU")},
+		{"2001:db8::/32", country("JP", "AS")},
+		{"2001:db8:1::/48", map[string]interface{}{
+			"registered_country": map[string]interface{}{"iso_code": "kr"},
+		}},
+	}
+	for _, n := range networks {
+		_, network, _ := net.ParseCIDR(n.cidr)
+		err := writer.Insert(network, n.record)
+		if ip_version == 4 && network.IP.To4() == nil {
+			if err == nil {
+				t.Errorf("IPv6 network %s should not be inserted to IPv4 database", n.cidr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Unable to insert %s: %s", n.cidr, err.Error())
+		}
+	}
+	buffer, err := writer.Bytes(record_size)
+	if err != nil {
+		t.Fatalf("Unable to build database: %s", err.Error())
+	}
+	reader, err := FromBytes(buffer)
+	if err != nil {
+		t.Fatalf("Unable to read database: %s", err.Error())
+	}
+	return reader
+}
+
+func TestLookup(t *testing.T) {
+	defer func() {
+		if r := recover(); r != nil {
+			t.Fatalf("Recovered from panic: %s", r)
+			return
+		}
+	}()
+	cases := []struct {
+		ip        string
+		v6        bool
+		country   string
+		continent string
+	}{
+		{"1.1.1.1", false, "US", "NA"},
+		{"1.2.3.4", false, "DE", "EU"},
+		{"::ffff:1.2.3.4", false, "DE", "EU"},
+		{"81.127.0.1", false, "FR", "EU"},
+		{"81.128.0.1", false, "", ""},
+		{"8.8.8.8", false, "", ""},
+		{"2001:db8:2::1", true, "JP", "AS"},
+		{"2001:db8:1::1", true, "KR", ""},
+		{"2001:db9::1", true, "", ""},
+	}
+	for _, version := range []uint{4, 6} {
+		for _, size := range []uint{24, 28, 32} {
+			reader := fixture(t, version, size)
+			if reader.Metadata.IPVersion != version || reader.Metadata.RecordSize != size ||
+				reader.Metadata.DatabaseType != "MineGate-Test" {
+				t.Errorf("Invalid metadata: %+v", reader.Metadata)
+			}
+			for _, c := range cases {
+				if c.v6 && version == 4 {
+					continue
+				}
+				country, continent, err := reader.Country(net.ParseIP(c.ip))
+				if err != nil || country != c.country || continent != c.continent {
+					t.Errorf("IPv%d/%d: %s should be in %s/%s, %s/%s found (%v)", version, size, c.ip,
+						c.country, c.continent, country, continent, err)
+				}
+			}
+		}
+	}
+	record, err := fixture(t, 6, 28).Lookup(net.ParseIP("1.2.3.4"))
+	fields, _ := record.(map[string]interface{})
+	if err != nil || fields["confidence"] != uint16(99) || fields["is_proxy"] != false {
+		t.Errorf("Invalid record: %+v", record)
+	}
+	if _, err := fixture(t, 4, 24).Lookup(net.ParseIP("2001:db8::1")); err == nil {
+		t.Error("IPv6 lookup in IPv4 database should fail")
+	}
+	if !t.Failed() {
+		t.Log("Ok, addresses found.")
+	}
+}
+
+func TestDecode(t *testing.T) {
+	defer func() {
+		if r := recover(); r != nil {
+			t.Fatalf("Recovered from panic: %s", r)
+			return
+		}
+	}()
+	data := []byte{
+		// 0: "abc"
+		0x43, 'a', 'b', 'c',
+		// 4: [pointer to 0, uint64 300]
+		0x02, 0x04, 0x20, 0x00, 0x02, 0x02, 0x01, 0x2c,
+		// 12: pointer loop
+		0x20, 0x0c,
+	}
+	value, next, err := decode(data, 4, 0)
+	array, _ := value.([]interface{})
+	if err != nil || next != 12 || len(array) != 2 || array[0] != "abc" || array[1] != uint64(300) {
+		t.Errorf("Invalid value: %+v, next %d (%v)", value, next, err)
+	}
+	if _, _, err = decode(data, 12, 0); err == nil {
+		t.Error("Pointer loop should be detected")
+	}
+	if _, _, err = decode(data[:2], 0, 0); err == nil {
+		t.Error("Truncated data should be detected")
+	}
+	defer os.Remove("geoip_test.mmdb")
+	if err = ioutil.WriteFile("geoip_test.mmdb", []byte("not a database"), 0644); err != nil {
+		t.Fatal("Unable to write to geoip_test.mmdb")
+	}
+	if _, err = Open("geoip_test.mmdb"); err == nil {
+		t.Error("Invalid database should not be opened")
+	}
+	if !t.Failed() {
+		t.Log("Ok, data decoded.")
+	}
+}
@@ -0,0 +1,260 @@
+// Package mmdbtest writes small MaxMind DB (MMDB) files, used as fixtures in
+// tests of geoip and its users.
+package mmdbtest
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"sort"
+)
+
+var metadata_marker = []byte("\xab\xcd\xefMaxMind.com")
+
+// Data section starts after search tree and 16 zero bytes.
+const data_separator = 16
+
+// Types of data fields.
+const (
+	typeExtended = iota
+	typePointer
+	typeString
+	typeDouble
+	typeBytes
+	typeUint16
+	typeUint32
+	typeMap
+	typeInt32
+	typeUint64
+	typeUint128
+	typeArray
+	typeContainer
+	typeEndMarker
+	typeBool
+	typeFloat
+)
+
+// Writer builds small databases. Records are maps, with strings, unsigned
+// integers, booleans, floats, slices and maps as values.
+type Writer struct {
+	DatabaseType string
+	ip_version   uint
+	root         *writerNode
+}
+
+type writerNode struct {
+	children [2]*writerNode
+	record   map[string]interface{}
+	number   uint
+}
+
+func NewWriter(ip_version uint) *Writer {
+	return &Writer{DatabaseType: "MineGate-Test", ip_version: ip_version, root: new(writerNode)}
+}
+
+// Insert sets record of network, replacing records of networks inside it.
+// IPv4 networks are stored in ::/96 of IPv6 databases.
+func (writer *Writer) Insert(network *net.IPNet, record map[string]interface{}) error {
+	ones, bits := network.Mask.Size()
+	ip := network.IP
+	if ip4 := ip.To4(); ip4 != nil && bits == 32 {
+		ip = ip4
+		if writer.ip_version == 6 {
+			ip = append(make(net.IP, 12), ip4...)
+			ones += 96
+		}
+	} else if writer.ip_version == 4 {
+		return errors.New("ipv6 network in ipv4 database")
+	}
+	if ones == 0 {
+		return errors.New("network too large")
+	}
+	node := writer.root
+	for i := 0; i < ones; i++ {
+		if node.record != nil {
+			// Split a larger network.
+			node.children[0] = &writerNode{record: node.record}
+			node.children[1] = &writerNode{record: node.record}
+			node.record = nil
+		}
+		bit := ip[i>>3] >> (7 - uint(i&7)) & 1
+		if node.children[bit] == nil {
+			node.children[bit] = new(writerNode)
+		}
+		node = node.children[bit]
+	}
+	node.children = [2]*writerNode{}
+	node.record = record
+	return nil
+}
+
+// Bytes encodes database with given record size (24, 28 or 32).
+func (writer *Writer) Bytes(record_size uint) (buffer []byte, err error) {
+	switch record_size {
+	case 24, 28, 32:
+	default:
+		return nil, fmt.Errorf("unsupported record size %d", record_size)
+	}
+	// Number internal nodes in breadth first order, root first.
+	var nodes []*writerNode
+	queue := []*writerNode{writer.root}
+	for len(queue) > 0 {
+		node := queue[0]
+		queue = queue[1:]
+		node.number = uint(len(nodes))
+		nodes = append(nodes, node)
+		for _, child := range node.children {
+			if child != nil && child.record == nil {
+				queue = append(queue, child)
+			}
+		}
+	}
+	count := uint(len(nodes))
+	data := new(bytes.Buffer)
+	tree := make([]byte, count*record_size/4)
+	for _, node := range nodes {
+		for bit, child := range node.children {
+			value := count
+			if child != nil && child.record != nil {
+				value = count + data_separator + uint(data.Len())
+				if err = encode(data, child.record); err != nil {
+					return nil, err
+				}
+			} else if child != nil {
+				value = child.number
+			}
+			if value >= 1<<record_size {
+				return nil, errors.New("database too large for record size")
+			}
+			putRecord(tree[node.number*record_size/4:], record_size, uint(bit), value)
+		}
+	}
+	out := new(bytes.Buffer)
+	out.Write(tree)
+	out.Write(make([]byte, data_separator))
+	out.Write(data.Bytes())
+	out.Write(metadata_marker)
+	err = encode(out, map[string]interface{}{
+		"binary_format_major_version": uint16(2),
+		"binary_format_minor_version": uint16(0),
+		"build_epoch":                 uint64(0),
+		"database_type":               writer.DatabaseType,
+		"description":                 map[string]interface{}{},
+		"ip_version":                  uint16(writer.ip_version),
+		"languages":                   []interface{}{},
+		"node_count":                  uint32(count),
+		"record_size":                 uint16(record_size),
+	})
+	return out.Bytes(), err
+}
+
+func putRecord(b []byte, size uint, bit uint, value uint) {
+	switch size {
+	case 24:
+		b = b[bit*3:]
+		b[0], b[1], b[2] = byte(value>>16), byte(value>>8), byte(value)
+	case 28:
+		if bit == 0 {
+			b[0], b[1], b[2] = byte(value>>16), byte(value>>8), byte(value)
+			b[3] = b[3]&0x0f | byte(value>>20)&0xf0
+		} else {
+			b[3] = b[3]&0xf0 | byte(value>>24)&0x0f
+			b[4], b[5], b[6] = byte(value>>16), byte(value>>8), byte(value)
+		}
+	default:
+		binary.BigEndian.PutUint32(b[bit*4:], uint32(value))
+	}
+}
+
+func encodeControl(out *bytes.Buffer, kind uint, size uint) {
+	var ext []byte
+	if kind > 7 {
+		ext = []byte{byte(kind - 7)}
+		kind = typeExtended
+	}
+	var extra []byte
+	switch {
+	case size < 29:
+	case size < 285:
+		extra = []byte{byte(size - 29)}
+		size = 29
+	case size < 65821:
+		extra = []byte{byte((size - 285) >> 8), byte(size - 285)}
+		size = 30
+	default:
+		size -= 65821
+		extra = []byte{byte(size >> 16), byte(size >> 8), byte(size)}
+		size = 31
+	}
+	out.WriteByte(byte(kind<<5) | byte(size))
+	out.Write(ext)
+	out.Write(extra)
+}
+
+func encodeUint(out *bytes.Buffer, kind uint, value uint64) {
+	var b []byte
+	for ; value != 0; value >>= 8 {
+		b = append([]byte{byte(value)}, b...)
+	}
+	encodeControl(out, kind, uint(len(b)))
+	out.Write(b)
+}
+
+func encode(out *bytes.Buffer, value interface{}) error {
+	switch v := value.(type) {
+	case string:
+		encodeControl(out, typeString, uint(len(v)))
+		out.WriteString(v)
+	case []byte:
+		encodeControl(out, typeBytes, uint(len(v)))
+		out.Write(v)
+	case float64:
+		encodeControl(out, typeDouble, 8)
+		binary.Write(out, binary.BigEndian, math.Float64bits(v))
+	case float32:
+		encodeControl(out, typeFloat, 4)
+		binary.Write(out, binary.BigEndian, math.Float32bits(v))
+	case bool:
+		size := uint(0)
+		if v {
+			size = 1
+		}
+		encodeControl(out, typeBool, size)
+	case uint16:
+		encodeUint(out, typeUint16, uint64(v))
+	case uint32:
+		encodeUint(out, typeUint32, uint64(v))
+	case uint64:
+		encodeUint(out, typeUint64, v)
+	case uint:
+		encodeUint(out, typeUint32, uint64(v))
+	case int32:
+		encodeUint(out, typeInt32, uint64(uint32(v)))
+	case []interface{}:
+		encodeControl(out, typeArray, uint(len(v)))
+		for _, item := range v {
+			if err := encode(out, item); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		encodeControl(out, typeMap, uint(len(v)))
+		for _, key := range keys {
+			encode(out, key)
+			if err := encode(out, v[key]); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported type %T", value)
+	}
+	return nil
+}
@@ -170,6 +170,39 @@ func (msg *ChatMsg) AsChatString() (chat_string []byte) {
 	return buffer.Bytes()
 }
 
+// AsLegacyString formats msg with section sign codes, which are used where
+// chat components are not supported, e.g. player list in status response.
+func (msg *ChatMsg) AsLegacyString() (legacy string) {
+	buffer := new(bytes.Buffer)
+	msg.writeLegacy(buffer)
+	return buffer.String()
+}
+
+func (msg *ChatMsg) writeLegacy(buffer *bytes.Buffer) {
+	if msg.Color == "reset" {
+		buffer.WriteString("\u00a7r")
+	} else if color := GetColor(msg.Color); color != -1 {
+		buffer.WriteString("\u00a7")
+		buffer.WriteByte("0123456789abcdef"[(color>>5)&15])
+	}
+	if msg.Bold {
+		buffer.WriteString("\u00a7l")
+	}
+	if msg.Italic {
+		buffer.WriteString("\u00a7o")
+	}
+	if msg.Underlined {
+		buffer.WriteString("\u00a7n")
+	}
+	if msg.Strikethrough {
+		buffer.WriteString("\u00a7m")
+	}
+	buffer.WriteString(msg.Text)
+	for _, extra := range msg.ExtraMsg {
+		extra.writeLegacy(buffer)
+	}
+}
+
 func GetColor(color string) (res Style) {
 	for idx, val := range color_string {
 		if val == color {
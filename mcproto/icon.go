@@ -0,0 +1,121 @@
+package mcproto
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"os"
+	"strings"
+)
+
+// Server icons must be 64x64 PNG images.
+const IconSize = 64
+
+// Longer icons would hardly fit in status response, which is limited to
+// 32767 characters.
+const IconMaxLength = 24 * 1024
+
+func NewIcon(png []byte) Icon {
+	return Icon(prefix + base64.StdEncoding.EncodeToString(png))
+}
+
+func (icon Icon) ToBinaryImage() (img []byte, err error) {
+	if !strings.HasPrefix(string(icon), prefix) {
+		return nil, errors.New("Invalid base64 icon data.")
+	}
+	return base64.StdEncoding.DecodeString(string(icon[prefix_len:]))
+}
+
+// Validate checks icon is a 64x64 PNG image, and is not too large.
+func (icon Icon) Validate() (err error) {
+	if len(icon) > IconMaxLength {
+		return fmt.Errorf("icon too large: %d bytes", len(icon))
+	}
+	img, err := icon.ToBinaryImage()
+	if err != nil {
+		return err
+	}
+	conf, format, err := image.DecodeConfig(bytes.NewReader(img))
+	if err != nil {
+		return err
+	}
+	if format != "png" {
+		return fmt.Errorf("icon should be png, %s found", format)
+	}
+	if conf.Width != IconSize || conf.Height != IconSize {
+		return fmt.Errorf("icon should be %dx%d, %dx%d found", IconSize, IconSize, conf.Width, conf.Height)
+	}
+	return nil
+}
+
+// ResizeImage scales img to width x height, averaging source pixels covered
+// by each pixel.
+func ResizeImage(img image.Image, width, height int) *image.RGBA {
+	res := image.NewRGBA(image.Rect(0, 0, width, height))
+	bounds := img.Bounds()
+	sw, sh := bounds.Dx(), bounds.Dy()
+	if sw == 0 || sh == 0 {
+		return res
+	}
+	for y := 0; y < height; y++ {
+		y0 := y * sh / height
+		y1 := (y + 1) * sh / height
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < width; x++ {
+			x0 := x * sw / width
+			x1 := (x + 1) * sw / width
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					pr, pg, pb, pa := img.At(bounds.Min.X+sx, bounds.Min.Y+sy).RGBA()
+					r, g, b, a = r+uint64(pr), g+uint64(pg), b+uint64(pb), a+uint64(pa)
+					n++
+				}
+			}
+			res.Set(x, y, color.RGBA64{uint16(r / n), uint16(g / n), uint16(b / n), uint16(a / n)})
+		}
+	}
+	return res
+}
+
+// EncodeIcon makes an icon from img, which is resized if it's not 64x64.
+func EncodeIcon(img image.Image) (icon Icon, err error) {
+	if bounds := img.Bounds(); bounds.Dx() != IconSize || bounds.Dy() != IconSize {
+		img = ResizeImage(img, IconSize, IconSize)
+	}
+	buff := new(bytes.Buffer)
+	encoder := png.Encoder{CompressionLevel: png.BestCompression}
+	if err = encoder.Encode(buff, img); err != nil {
+		return "", err
+	}
+	icon = NewIcon(buff.Bytes())
+	if err = icon.Validate(); err != nil {
+		return "", err
+	}
+	return icon, nil
+}
+
+// LoadIcon reads an icon from a PNG, JPEG or GIF file.
+func LoadIcon(path string) (icon Icon, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	img, _, err := image.Decode(file)
+	if err != nil {
+		return "", err
+	}
+	return EncodeIcon(img)
+}
@@ -0,0 +1,84 @@
+package mcproto
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestLoadIcon(t *testing.T) {
+	defer func() {
+		if r := recover(); r != nil {
+			t.Fatalf("Recovered from panic: %s", r)
+			return
+		}
+	}()
+	defer os.Remove("icon_test.jpg")
+	src := image.NewRGBA(image.Rect(0, 0, 200, 100))
+	for y := 0; y < 100; y++ {
+		for x := 0; x < 200; x++ {
+			src.Set(x, y, color.RGBA{uint8(x), uint8(y), 0, 255})
+		}
+	}
+	buff := new(bytes.Buffer)
+	if err := jpeg.Encode(buff, src, nil); err != nil {
+		t.Fatal("Unable to encode jpeg: " + err.Error())
+	}
+	if err := ioutil.WriteFile("icon_test.jpg", buff.Bytes(), 0644); err != nil {
+		t.Fatal("Unable to write to icon_test.jpg")
+	}
+	icon, err := LoadIcon("icon_test.jpg")
+	if err != nil {
+		t.Fatal("Unable to load icon: " + err.Error())
+	}
+	if err = icon.Validate(); err != nil {
+		t.Fatal("Loaded icon is invalid: " + err.Error())
+	}
+	data, err := icon.ToBinaryImage()
+	if err != nil {
+		t.Fatal("Unable to decode icon: " + err.Error())
+	}
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal("Icon is not png: " + err.Error())
+	}
+	if bounds := img.Bounds(); bounds.Dx() != IconSize || bounds.Dy() != IconSize {
+		t.Errorf("Icon should be resized to 64x64, %dx%d found", bounds.Dx(), bounds.Dy())
+	} else {
+		t.Log("Ok, icon resized to 64x64")
+	}
+}
+
+func TestValidateIcon(t *testing.T) {
+	defer func() {
+		if r := recover(); r != nil {
+			t.Fatalf("Recovered from panic: %s", r)
+			return
+		}
+	}()
+	if err := Icon(transparent_png).Validate(); err == nil {
+		t.Error("1x1 icon should be invalid")
+	}
+	if _, err := Icon("data:image/png;base64,!!!").ToBinaryImage(); err == nil {
+		t.Error("Broken base64 data should not be decoded")
+	}
+	if err := Icon("data:image/png;base64,AAAA").Validate(); err == nil {
+		t.Error("Broken image should be invalid")
+	}
+	if err := NewIcon(make([]byte, IconMaxLength)).Validate(); err == nil {
+		t.Error("Oversized icon should be invalid")
+	}
+	buff := new(bytes.Buffer)
+	png.Encode(buff, image.NewRGBA(image.Rect(0, 0, IconSize, IconSize)))
+	if err := NewIcon(buff.Bytes()).Validate(); err != nil {
+		t.Error("64x64 png icon should be valid: " + err.Error())
+	}
+	if !t.Failed() {
+		t.Log("Ok, icons validated.")
+	}
+}
@@ -1,15 +1,14 @@
 package mcproto
 
 import (
-	"encoding/base64"
 	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	mcchat "github.com/jackyyf/MineGate-Go/mcchat"
 	log "github.com/jackyyf/golog"
 	"io"
-	"strings"
 )
 
 type RAWPacket struct {
@@ -51,12 +50,21 @@ type MCHandShake struct {
 
 type MCLogin struct {
 	Name string
+	// Fields after name sent by newer clients (e.g. player UUID), forwarded
+	// as is.
+	Extra []byte
 }
 
 type Icon string
 
 type MCKick mcchat.ChatMsg
 
+// StatusPlayer is a line of player list shown when hovering on player count.
+type StatusPlayer struct {
+	Name string `json:"name"`
+	ID   string `json:"id"`
+}
+
 type MCStatusResponse struct {
 	// ID is always 0x00
 	Version struct {
@@ -64,9 +72,9 @@ type MCStatusResponse struct {
 		Protocol int    `json:"protocol"`
 	} `json:"version"`
 	Players struct {
-		Max    int `json:"max"`
-		Online int `json:"online"`
-		// Sample [0]int `json:"sample"`
+		Max    int            `json:"max"`
+		Online int            `json:"online"`
+		Sample []StatusPlayer `json:"sample,omitempty"`
 	} `json:"players"`
 	Description *mcchat.ChatMsg `json:"description"`
 	Favicon     Icon            `json:"favicon,omitempty"`
@@ -79,24 +87,14 @@ type MCSimpleStatusResponse struct {
 		Protocol int    `json:"protocol"`
 	} `json:"version"`
 	Players struct {
-		Max    int `json:"max"`
-		Online int `json:"online"`
-		// Sample [0]int `json:"sample"`
+		Max    int            `json:"max"`
+		Online int            `json:"online"`
+		Sample []StatusPlayer `json:"sample,omitempty"`
 	} `json:"players"`
 	Description string `json:"description"`
 	Favicon     Icon   `json:"favicon,omitempty"`
 }
 
-func (icon Icon) ToBinaryImage() (img []byte, err error) {
-	if !strings.HasPrefix(string(icon), prefix) {
-		return nil, errors.New("Invalid base64 icon data.")
-	}
-	data := []byte(icon[len(prefix):])
-	img = make([]byte, base64.StdEncoding.DecodedLen(len(data)))
-	base64.StdEncoding.Decode(img, data)
-	return img, nil
-}
-
 func IsOldClient(err error) (old bool) {
 	_, old = err.(OldClient)
 	return
@@ -243,6 +241,7 @@ func (pkt *RAWPacket) ToKick() (kick *MCKick, err error) {
 	if len(pkt.Payload) != l {
 		return nil, errors.New("Invalid packet: extra field.")
 	}
+	kick = new(MCKick)
 	err = json.Unmarshal(s, kick)
 	if err != nil {
 		return nil, err
@@ -355,14 +354,33 @@ func (pkt *RAWPacket) ToLogin() (login *MCLogin, err error) {
 	if err != nil {
 		return nil, err
 	}
-	if len(pkt.Payload) != l {
-		return nil, fmt.Errorf("Unexpected extra %d bytes data.", len(pkt.Payload)-l)
-	}
 	login = new(MCLogin)
 	login.Name = name
+	if len(pkt.Payload) != l {
+		login.Extra = pkt.Payload[l:]
+	}
 	return login, nil
 }
 
+// PlayerUUID returns the UUID sent by 1.19.3+ clients, in dashed form.
+func (login *MCLogin) PlayerUUID() (uuid string, ok bool) {
+	var raw []byte
+	switch {
+	case len(login.Extra) == 16: // 1.20.2+
+		raw = login.Extra
+	case len(login.Extra) == 17 && login.Extra[0] == 1: // 1.19.3 - 1.20.1, optional uuid
+		raw = login.Extra[1:]
+	default:
+		return "", false
+	}
+	return FormatUUID(raw), true
+}
+
+func FormatUUID(raw []byte) (uuid string) {
+	return hex.EncodeToString(raw[:4]) + "-" + hex.EncodeToString(raw[4:6]) + "-" + hex.EncodeToString(raw[6:8]) +
+		"-" + hex.EncodeToString(raw[8:10]) + "-" + hex.EncodeToString(raw[10:16])
+}
+
 func (kick *MCKick) ToRawPacket() (pkt *RAWPacket, err error) {
 	json_str, err := json.Marshal(kick)
 	if err != nil {
@@ -442,7 +460,7 @@ func (login *MCLogin) ToRawPacket() (pkt *RAWPacket, err error) {
 	}
 	return &RAWPacket{
 		ID:      0,
-		Payload: WriteMCString(login.Name),
+		Payload: append(WriteMCString(login.Name), login.Extra...),
 	}, nil
 }
 
@@ -186,6 +186,37 @@ func TestEncodeLogin(t *testing.T) {
 	}
 }
 
+func TestParseKick(t *testing.T) {
+	defer func() {
+		if r := recover(); r != nil {
+			t.Fatalf("Recovered from panic: %s", r)
+			return
+		}
+	}()
+	rawpkt := &RAWPacket{ID: 0, Payload: WriteMCByteString([]byte(`{"text":"Server closed","color":"red"}`))}
+	kick, err := rawpkt.ToKick()
+	if err != nil {
+		t.Fatal("Unable to decode kick packet: " + err.Error())
+	}
+	if kick.Text != "Server closed" {
+		t.Errorf("Kick message mismatch, expect Server closed, found %s", kick.Text)
+	}
+	rawpkt, err = kick.ToRawPacket()
+	if err != nil {
+		t.Fatal("Unable to encode back packet: " + err.Error())
+	}
+	if kick, err = rawpkt.ToKick(); err != nil || kick.Text != "Server closed" {
+		t.Errorf("Re-encoded kick packet mismatch: %+v, %v", kick, err)
+	}
+	rawpkt.ID = 1
+	if _, err = rawpkt.ToKick(); err == nil {
+		t.Error("Packet with id 1 should not be decoded as kick")
+	}
+	if !t.Failed() {
+		t.Log("Ok, kick packet parsed correctly.")
+	}
+}
+
 func TestWriteMCString(t *testing.T) {
 	defer func() {
 		if r := recover(); r != nil {
@@ -20,13 +20,22 @@ type LogOptions struct {
 }
 
 type Config struct {
-	Log          LogOptions             `yaml:log`
-	Daemonize    bool                   `yaml:"daemon"`
-	Listen_addr  string                 `yaml:"listen"`
-	Upstream     []*Upstream            `yaml:"upstreams"`
-	NotFound     ChatMessage            `yaml:"host_not_found"`
-	chatNotFound *mcchat.ChatMsg        `yaml:"-"`
-	Extras       map[string]interface{} `yaml:",inline"`
+	Log            LogOptions               `yaml:log`
+	Daemonize      bool                     `yaml:"daemon"`
+	Listen_addr    string                   `yaml:"listen"`
+	Upstream       []*Upstream              `yaml:"upstreams"`
+	NotFound       ChatMessage              `yaml:"host_not_found"`
+	NotFoundIcon   StringList               `yaml:"host_not_found_favicon"`
+	PlayerRoutes   string                   `yaml:"player_routes"`
+	GeoIP          string                   `yaml:"geoip"`
+	Registry       RegistryOptions          `yaml:"registry"`
+	RouteProviders []map[string]interface{} `yaml:"route_providers"`
+	chatNotFound   *mcchat.ChatMsg          `yaml:"-"`
+	iconNotFound   iconSet                  `yaml:"-"`
+	routes         *routeTable              `yaml:"-"`
+	named          map[string]*Upstream     `yaml:"-"`
+	providers      []RouteProvider          `yaml:"-"`
+	Extras         map[string]interface{}   `yaml:",inline"`
 }
 
 var config Config
@@ -124,6 +133,20 @@ func validateConfig() {
 		config.NotFound.Text = "No such host."
 	}
 	config.chatNotFound = ToChatMsg(&config.NotFound)
+	config.iconNotFound = loadIcons(config.NotFoundIcon)
+	rebuildRoutes()
+	old_providers := config.providers
+	config.providers = buildProviders(config.RouteProviders)
+	stopProviders(old_providers)
+	setPlayerRoutesFile(config.PlayerRoutes)
+	setGeoIPFile(config.GeoIP)
+	if !GeoIPLoaded() {
+		for _, upstream := range config.Upstream {
+			if len(upstream.countries) > 0 || len(upstream.continents) > 0 {
+				log.Warnf("No geoip database loaded, country rules of %s never match.", upstream.Server)
+			}
+		}
+	}
 }
 
 func confInit() {
@@ -159,6 +182,7 @@ func confInit() {
 			log.Fatalf("Unable to open log %s: %s", config.Log.Target, err.Error())
 		}
 	}
+	startRegistry(config.Registry)
 	log.Info("config loaded.")
 	log.Info("server listen on: " + config.Listen_addr)
 	log.Infof("%d upstream server(s) found", len(config.Upstream))
@@ -186,7 +210,9 @@ func ConfReload() {
 		return
 	}
 	validateConfig()
+	registry_options := config.Registry
 	config_lock.Unlock()
+	startRegistry(registry_options)
 	log.Info("config reloaded.")
 	if config.Listen_addr != prev_listen {
 		log.Warnf("config reload will not reopen server socket, thus no effect on listen address")
@@ -211,3 +211,37 @@ upstreams:
 		t.Log("Ok, value is true.")
 	}
 }
+
+func TestPatternAlias(t *testing.T) {
+	defer func() {
+		if r := recover(); r != nil {
+			t.Fatalf("Recovered from panic: %s", r)
+			return
+		}
+	}()
+	defer os.Remove("pattern_alias.yml")
+	log.SetLogLevel(log.FATAL)
+	if err := ioutil.WriteFile("pattern_alias.yml", []byte(
+		`
+listen: '[::]:23333'
+upstreams:
+  - hostname: [Server.Local, '*.server.local']
+    upstream: test.local:23345`), 0644); err != nil {
+		t.Fatal("Unable to write to pattern_alias.yml")
+		return
+	}
+	SetConfig("pattern_alias.yml")
+	confInit()
+	if len(config.Upstream) != 1 || config.Upstream[0].Pattern != "server.local" {
+		t.Fatalf("Pattern should be the first hostname: %+v", config.Upstream)
+		return
+	}
+	upstream := &Upstream{Pattern: "Old.Example.com", Server: "10.0.0.1"}
+	if !upstream.Validate() || len(upstream.Patterns) != 1 || upstream.Patterns[0] != "old.example.com" ||
+		upstream.Pattern != "old.example.com" {
+		t.Errorf("Pattern should be used without hostname list: %+v", upstream)
+	}
+	if !t.Failed() {
+		t.Log("Ok, Pattern kept for compatibility.")
+	}
+}
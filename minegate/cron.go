@@ -0,0 +1,115 @@
+package minegate
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CronExpr is a 5 field cron expression (minute, hour, day of month, month
+// and day of week), matched against a point of time.
+type CronExpr struct {
+	minute  uint64
+	hour    uint64
+	dom     uint64
+	month   uint64
+	dow     uint64
+	dom_any bool
+	dow_any bool
+}
+
+var cron_months = []string{"", "jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}
+var cron_days = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+func parseCronValue(val string, names []string) (res int, err error) {
+	for idx, name := range names {
+		if name != "" && strings.ToLower(val) == name {
+			return idx, nil
+		}
+	}
+	return strconv.Atoi(val)
+}
+
+// parseCronField parses lists of *, N, N-M, with optional /STEP.
+func parseCronField(field string, min, max int, names []string) (bits uint64, err error) {
+	for _, part := range strings.Split(field, ",") {
+		step, stepped := 1, false
+		if idx := strings.Index(part, "/"); idx != -1 {
+			stepped = true
+			if step, err = strconv.Atoi(part[idx+1:]); err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step in %s", part)
+			}
+			part = part[:idx]
+		}
+		lo, hi := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			if lo, err = parseCronValue(bounds[0], names); err != nil {
+				return 0, fmt.Errorf("invalid value %s", bounds[0])
+			}
+			if len(bounds) == 2 {
+				if hi, err = parseCronValue(bounds[1], names); err != nil {
+					return 0, fmt.Errorf("invalid value %s", bounds[1])
+				}
+			} else if !stepped {
+				hi = lo
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("%s out of range %d-%d", part, min, max)
+		}
+		for val := lo; val <= hi; val += step {
+			bits |= 1 << uint(val)
+		}
+	}
+	return bits, nil
+}
+
+// ParseCron parses expressions like "* 15-20 * * mon-fri" or "0 */2 1 * *".
+// Day of week 7 is also sunday. As in cron, if both day of month and day of
+// week are restricted, either of them matching is enough. A field covering
+// its whole range (like * or */1) is not restricted.
+func ParseCron(expr string) (cron *CronExpr, err error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, errors.New("cron expression should have 5 fields: " + expr)
+	}
+	cron = new(CronExpr)
+	if cron.minute, err = parseCronField(fields[0], 0, 59, nil); err != nil {
+		return nil, err
+	}
+	if cron.hour, err = parseCronField(fields[1], 0, 23, nil); err != nil {
+		return nil, err
+	}
+	if cron.dom, err = parseCronField(fields[2], 1, 31, nil); err != nil {
+		return nil, err
+	}
+	if cron.month, err = parseCronField(fields[3], 1, 12, cron_months); err != nil {
+		return nil, err
+	}
+	if cron.dow, err = parseCronField(fields[4], 0, 7, cron_days); err != nil {
+		return nil, err
+	}
+	if cron.dow&(1<<7) != 0 {
+		cron.dow |= 1
+	}
+	cron.dom_any = cron.dom == 0xfffffffe
+	cron.dow_any = cron.dow&0x7f == 0x7f
+	return cron, nil
+}
+
+// Match reports whether t (in its own location) is matched by cron.
+func (cron *CronExpr) Match(t time.Time) bool {
+	if cron.minute&(1<<uint(t.Minute())) == 0 || cron.hour&(1<<uint(t.Hour())) == 0 ||
+		cron.month&(1<<uint(t.Month())) == 0 {
+		return false
+	}
+	dom := cron.dom&(1<<uint(t.Day())) != 0
+	dow := cron.dow&(1<<uint(t.Weekday())) != 0
+	if cron.dom_any || cron.dow_any {
+		return dom && dow
+	}
+	return dom || dow
+}
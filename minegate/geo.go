@@ -0,0 +1,130 @@
+package minegate
+
+import (
+	"github.com/jackyyf/MineGate-Go/geoip"
+	log "github.com/jackyyf/golog"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Country and continent of clients are looked up from the MaxMind database
+// (e.g. GeoLite2-Country.mmdb) set by geoip, which is reloaded on SIGHUP, and
+// when it's modified.
+
+var geoip_lock sync.Mutex
+var geoip_reader *geoip.Reader
+var geoip_file string
+var geoip_stop func()
+
+// Bumped whenever a database is loaded, so lookups cached by plugins can be
+// dropped.
+var geoip_generation uint64
+
+var continents = map[string]bool{
+	"AF": true, "AN": true, "AS": true, "EU": true, "NA": true, "OC": true, "SA": true,
+}
+
+func loadGeoIP() {
+	geoip_lock.Lock()
+	file := geoip_file
+	geoip_lock.Unlock()
+	if file == "" {
+		return
+	}
+	reader, err := geoip.Open(file)
+	if err != nil {
+		log.Errorf("unable to load geoip database %s: %s", file, err.Error())
+		return
+	}
+	geoip_lock.Lock()
+	geoip_reader = reader
+	geoip_generation++
+	geoip_lock.Unlock()
+	log.Infof("geoip database %s (%s) loaded", file, reader.Metadata.DatabaseType)
+}
+
+func setGeoIPFile(file string) {
+	if file != "" {
+		file, _ = filepath.Abs(file)
+	}
+	geoip_lock.Lock()
+	if geoip_stop != nil {
+		geoip_stop()
+		geoip_stop = nil
+	}
+	geoip_file = file
+	if file == "" && geoip_reader != nil {
+		geoip_reader = nil
+		geoip_generation++
+	}
+	geoip_lock.Unlock()
+	if file == "" {
+		return
+	}
+	loadGeoIP()
+	stop := WatchFile(file, 5*time.Second, loadGeoIP)
+	geoip_lock.Lock()
+	geoip_stop = stop
+	geoip_lock.Unlock()
+}
+
+// GeoIPLoaded tells whether a geoip database is available.
+func GeoIPLoaded() bool {
+	geoip_lock.Lock()
+	defer geoip_lock.Unlock()
+	return geoip_reader != nil
+}
+
+// GeoIPGeneration changes whenever geoip database is (re)loaded or dropped.
+func GeoIPGeneration() uint64 {
+	geoip_lock.Lock()
+	defer geoip_lock.Unlock()
+	return geoip_generation
+}
+
+// LookupCountry returns ISO country code and continent code of ip, empty if
+// unknown or no database is loaded.
+func LookupCountry(ip net.IP) (country, continent string) {
+	geoip_lock.Lock()
+	reader := geoip_reader
+	geoip_lock.Unlock()
+	if reader == nil || ip == nil {
+		return "", ""
+	}
+	country, continent, err := reader.Country(ip)
+	if err != nil {
+		log.Warnf("geoip lookup of %s: %s", ip, err.Error())
+	}
+	return
+}
+
+// parseCountries normalizes country (or continent) codes.
+func parseCountries(list StringList, continent bool) (codes map[string]bool, ok bool) {
+	if len(list) == 0 {
+		return nil, true
+	}
+	codes = make(map[string]bool, len(list))
+	for _, code := range list {
+		code = strings.ToUpper(strings.TrimSpace(code))
+		if len(code) != 2 || (continent && !continents[code]) {
+			log.Errorf("Invalid country or continent code %s", code)
+			return nil, false
+		}
+		codes[code] = true
+	}
+	return codes, true
+}
+
+// geo looks up country and continent of client once.
+func (req *RouteRequest) geo() (country, continent string) {
+	if !req.geo_done {
+		req.geo_done = true
+		if req.RemoteAddr != nil {
+			req.country, req.continent = LookupCountry(req.RemoteAddr.IP)
+		}
+	}
+	return req.country, req.continent
+}
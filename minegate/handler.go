@@ -1,7 +1,6 @@
 package minegate
 
 import (
-	"errors"
 	"github.com/jackyyf/MineGate-Go/mcchat"
 	"github.com/jackyyf/MineGate-Go/mcproto"
 	log "github.com/jackyyf/golog"
@@ -45,90 +44,115 @@ func PipeIt(reader *WrapedSocket, writer *WrapedSocket) {
 	}
 }
 
+// readStatusRequest reads status request from client, conn is closed on error.
+func readStatusRequest(conn *WrapedSocket) (ok bool) {
+	pkt, err := mcproto.ReadPacket(conn)
+	if err != nil {
+		conn.Errorf("Error when reading status request: %s", err.Error())
+		conn.Close()
+		return false
+	}
+	if !pkt.IsStatusRequest() {
+		conn.Errorf("Invalid protocol: no status request.")
+		conn.Close()
+		return false
+	}
+	conn.Debugf("status: request")
+	return true
+}
+
+// statusReply sends status response to client, echoes its ping and closes conn.
+func statusReply(conn *WrapedSocket, resp *mcproto.MCStatusResponse) {
+	defer conn.Close()
+	resp_pkt, err := resp.ToRawPacket()
+	if err != nil {
+		conn.Errorf("Unable to make packet: %s", err.Error())
+		return
+	}
+	_, err = conn.Write(resp_pkt.ToBytes())
+	if err != nil {
+		conn.Errorf("Unable to write response: %s", err.Error())
+		return
+	}
+	pkt, err := mcproto.ReadPacket(conn)
+	if err != nil {
+		if err != io.EOF {
+			conn.Errorf("Unable to read packet: %s", err.Error())
+		}
+		return
+	}
+	if !pkt.IsStatusPing() {
+		conn.Errorf("Invalid protocol: no status ping.")
+		return
+	}
+	conn.Write(pkt.ToBytes()) // Don't care now.
+}
+
+func rejectStatus(e *mcchat.ChatMsg, icon mcproto.Icon) (resp *mcproto.MCStatusResponse) {
+	resp = new(mcproto.MCStatusResponse)
+	resp.Description = e
+	resp.Version.Name = "minegate"
+	resp.Version.Protocol = 0
+	resp.Favicon = icon
+	return
+}
+
 func RejectHandler(conn *WrapedSocket, initial_pkt *mcproto.MCHandShake, e *mcchat.ChatMsg) {
+	rejectHandler(conn, initial_pkt, e, "")
+}
+
+func rejectHandler(conn *WrapedSocket, initial_pkt *mcproto.MCHandShake, e *mcchat.ChatMsg, icon mcproto.Icon) {
 	if initial_pkt.NextState == 1 {
 		conn.Infof("ping packet")
-		pkt, err := mcproto.ReadPacket(conn)
-		if err != nil {
-			conn.Errorf("Error when reading status request: %s", err.Error())
-			conn.Close()
-			return
-		}
-		if !pkt.IsStatusRequest() {
-			conn.Errorf("Invalid protocol: no status request.")
-			conn.Close()
-			return
-		}
-		conn.Debugf("status: request")
-		resp := new(mcproto.MCStatusResponse)
-		resp.Description = e
-		resp.Version.Name = "minegate"
-		resp.Version.Protocol = 0
-		resp_pkt, err := resp.ToRawPacket()
-		if err != nil {
-			conn.Errorf("Unable to make packet: %s", err.Error())
-			conn.Close()
-			return
-		}
-		_, err = conn.Write(resp_pkt.ToBytes())
-		if err != nil {
-			log.Errorf("Unable to write response: %s", err.Error())
-			conn.Close()
-			return
-		}
-		pkt, err = mcproto.ReadPacket(conn)
-		if err != nil {
-			if err != io.EOF {
-				log.Errorf("Unable to read packet: %s", err.Error())
-			}
-			conn.Close()
-			return
-		}
-		if !pkt.IsStatusPing() {
-			log.Error("Invalid protocol: no status ping.")
-			conn.Close()
-			return
-		}
-		conn.Write(pkt.ToBytes()) // Don't care now.
-	} else {
-		log.Info("login packet")
-		kick_pkt := (*mcproto.MCKick)(e)
-		raw_pkt, err := kick_pkt.ToRawPacket()
-		if err != nil {
-			log.Errorf("Unable to make packet: %s", err.Error())
-			conn.Close()
-			return
+		if readStatusRequest(conn) {
+			statusReply(conn, rejectStatus(e, icon))
 		}
-		// Don't care now
-		conn.Write(raw_pkt.ToBytes())
+		return
 	}
+	log.Info("login packet")
+	kick_pkt := (*mcproto.MCKick)(e)
+	raw_pkt, err := kick_pkt.ToRawPacket()
+	if err != nil {
+		log.Errorf("Unable to make packet: %s", err.Error())
+		conn.Close()
+		return
+	}
+	// Don't care now
+	conn.Write(raw_pkt.ToBytes())
 	conn.Close()
-	return
 }
 
-func proxy(conn *WrapedSocket, upstream *Upstream, initial_pkt *mcproto.MCHandShake, ne *PostAcceptEvent) {
-	addr, perr := net.ResolveTCPAddr("tcp", upstream.Server)
-	var err error
-	var upsock *net.TCPConn
-	if perr == nil {
-		upsock, err = net.DialTCP("tcp", nil, addr)
+// rejectNotFound rejects client as if no upstream matched hostname.
+func rejectNotFound(conn *WrapedSocket, initial_pkt *mcproto.MCHandShake, e *mcchat.ChatMsg) {
+	config_lock.Lock()
+	icon := config.iconNotFound.pick()
+	config_lock.Unlock()
+	rejectHandler(conn, initial_pkt, e, icon)
+}
+
+func dialUpstream(connID uint64, upstream *Upstream) (upconn *WrapedSocket, err error) {
+	addr, err := net.ResolveTCPAddr("tcp", upstream.Server)
+	if err != nil {
+		return nil, err
 	}
-	if err != nil || perr != nil {
-		if err == nil {
-			err = perr
-		}
-		log.Errorf("Unable to connect to upstream %s", upstream.Server)
-		RejectHandler(conn, initial_pkt, upstream.ChatMsg)
-		return
+	upsock, err := net.DialTCP("tcp", nil, addr)
+	if err != nil {
+		return nil, err
 	}
-	upconn := WrapUpstreamSocket(upsock, conn)
+	return wrapUpstreamSocket(upsock, connID), nil
+}
+
+// proxy serves client with upstream routed to. Events get routed itself, the
+// copy with active schedules applied is used for everything else.
+func proxy(conn *WrapedSocket, routed *Upstream, initial_pkt *mcproto.MCHandShake, ne *PostAcceptEvent, code *joinCodeUse) {
+	upstream := routed.scheduled()
 	if initial_pkt.NextState == 1 {
 		// Handle ping here.
 		conn.Debugf("ping proxy")
 		pre := new(PingRequestEvent)
 		pre.NetworkEvent = ne.NetworkEvent
 		pre.Packet = initial_pkt
-		pre.Upstream = upstream
+		pre.Upstream = routed
 		PingRequest(pre)
 		if pre.Rejected() {
 			if pre.reason == "" {
@@ -143,81 +167,29 @@ func proxy(conn *WrapedSocket, upstream *Upstream, initial_pkt *mcproto.MCHandSh
 			RejectHandler(conn, initial_pkt, e)
 			return
 		}
-		init_raw, err := initial_pkt.ToRawPacket()
-		if err != nil {
-			log.Errorf("Unable to encode initial packet: %s", err.Error())
-			conn.Close()
-			upconn.Close()
-			return
-		}
-		pkt, err := mcproto.ReadPacket(conn)
-		if err != nil {
-			conn.Errorf("Error when reading status request: %s", err.Error())
-			conn.Close()
-			upconn.Close()
-			return
-		}
-		if !pkt.IsStatusRequest() {
-			conn.Errorf("Invalid protocol: no status request.")
-			conn.Close()
-			upconn.Close()
-			return
-		}
-		_, err = upconn.Write(init_raw.ToBytes())
-		if err == nil {
-			_, err = upconn.Write(pkt.ToBytes())
-		}
-		if err != nil {
-			upconn.Errorf("write error: %s", err.Error())
-			conn.Close()
-			upconn.Close()
+		if !readStatusRequest(conn) {
 			return
 		}
-		resp_pkt, err := mcproto.ReadPacket(upconn)
-		if err != nil {
-			upconn.Errorf("invalid packet: %s", err.Error())
-			conn.Close()
-			upconn.Close()
-			return
+		var resp *mcproto.MCStatusResponse
+		var err error
+		if upstream.InMaintenance() && !upstream.Maintenance.Bypassed(ne.RemoteAddr, "") {
+			conn.Infof("upstream %s is under maintenance", upstream.Server)
+			resp = upstream.Maintenance.status()
+		} else if resp, err = FetchStatus(conn.Id(), upstream, initial_pkt); err != nil {
+			conn.Errorf("Unable to get status of upstream %s: %s", upstream.Server, err.Error())
+			resp = rejectStatus(upstream.errorMsg(), "")
 		}
-		resp, err := resp_pkt.ToStatusResponse()
-		if err != nil {
-			upconn.Errorf("invalid packet: %s", err.Error())
-			conn.Close()
-			upconn.Close()
-			return
+		if icon := upstream.icons.pick(); icon != "" {
+			resp.Favicon = icon
 		}
 		psre := new(PreStatusResponseEvent)
 		psre.NetworkEvent = ne.NetworkEvent
+		psre.InitPacket = initial_pkt
 		psre.Packet = resp
-		psre.Upstream = upstream
+		psre.Upstream = routed
+		psre.Err = err
 		PreStatusResponse(psre)
-		resp_pkt, err = resp.ToRawPacket()
-		if err != nil {
-			conn.Errorf("invalid packet: %s", err.Error())
-			conn.Close()
-			upconn.Close()
-			return
-		}
-		// We can handle ping request, close upstream
-		upconn.Close()
-		_, err = conn.Write(resp_pkt.ToBytes())
-		if err != nil {
-			conn.Errorf("write error: %s", err.Error())
-			conn.Close()
-			return
-		}
-		ping_pkt, err := mcproto.ReadPacket(conn)
-		if err != nil || !ping_pkt.IsStatusPing() {
-			if err == nil {
-				err = errors.New("packet is not ping")
-			}
-			conn.Errorf("invalid packet: %s", err.Error())
-			conn.Close()
-			return
-		}
-		_, err = conn.Write(ping_pkt.ToBytes())
-		conn.Close()
+		statusReply(conn, resp)
 	} else {
 		// Handle login here.
 		conn.Debugf("login proxy")
@@ -233,11 +205,16 @@ func proxy(conn *WrapedSocket, upstream *Upstream, initial_pkt *mcproto.MCHandSh
 			conn.Close()
 			return
 		}
+		if override, ok := RoutePlayer(upstream, login_pkt); ok {
+			conn.Infof("player %s routed to %s", login_pkt.Name, override.Server)
+			routed = override
+			upstream = routed.scheduled()
+		}
 		lre := new(LoginRequestEvent)
 		lre.NetworkEvent = ne.NetworkEvent
 		lre.InitPacket = initial_pkt
 		lre.LoginPacket = login_pkt
-		lre.Upstream = upstream
+		lre.Upstream = routed
 		LoginRequest(lre)
 		if lre.Rejected() {
 			if lre.reason == "" {
@@ -252,16 +229,75 @@ func proxy(conn *WrapedSocket, upstream *Upstream, initial_pkt *mcproto.MCHandSh
 			RejectHandler(conn, initial_pkt, e)
 			return
 		}
-		init_raw, err := initial_pkt.ToRawPacket()
+		if lre.Upstream != nil && lre.Upstream != routed {
+			conn.Infof("upstream %s chosen by plugin", lre.Upstream.Server)
+			routed = lre.Upstream
+			upstream = routed.scheduled()
+		}
+		if upstream.InMaintenance() && !upstream.Maintenance.Bypassed(ne.RemoteAddr, login_pkt.Name) {
+			conn.Infof("upstream %s is under maintenance, kicking %s", upstream.Server, login_pkt.Name)
+			// Login has been accepted by plugins, let them know it's over.
+			de := new(DisconnectEvent)
+			de.NetworkEvent = ne.NetworkEvent
+			Disconnect(de)
+			RejectHandler(conn, initial_pkt, upstream.Maintenance.kickMsg())
+			return
+		}
+		if upstream.loginClosed != nil {
+			conn.Infof("upstream %s is closed by schedule, kicking %s", upstream.Server, login_pkt.Name)
+			de := new(DisconnectEvent)
+			de.NetworkEvent = ne.NetworkEvent
+			Disconnect(de)
+			RejectHandler(conn, initial_pkt, upstream.loginClosed)
+			return
+		}
+		// Session is started here, so slots are taken before dialing.
+		if kick := admitPlayer(upstream, login_pkt.Name); kick != nil {
+			conn.Infof("upstream %s is full, kicking %s", upstream.Server, login_pkt.Name)
+			de := new(DisconnectEvent)
+			de.NetworkEvent = ne.NetworkEvent
+			Disconnect(de)
+			RejectHandler(conn, initial_pkt, kick)
+			return
+		}
+		upconn, err := dialUpstream(conn.Id(), upstream)
+		if err != nil {
+			conn.Errorf("Unable to connect to upstream %s: %s", upstream.Server, err.Error())
+			sessionEnd(upstream.Server)
+			de := new(DisconnectEvent)
+			de.NetworkEvent = ne.NetworkEvent
+			Disconnect(de)
+			RejectHandler(conn, initial_pkt, upstream.errorMsg())
+			return
+		}
+		// Join code is counted only for players who actually get in.
+		if err = code.commit(); err != nil {
+			conn.Warnf("%s for %s", err.Error(), code.upstream.Server)
+			upconn.Close()
+			sessionEnd(upstream.Server)
+			de := new(DisconnectEvent)
+			de.NetworkEvent = ne.NetworkEvent
+			Disconnect(de)
+			RejectHandler(conn, initial_pkt, code.upstream.JoinCodes.kick)
+			return
+		}
+		// Plugins still get the handshake sent by client.
+		upstream_pkt := *initial_pkt
+		upstream.RewriteHandshake(&upstream_pkt)
+		init_raw, err := upstream_pkt.ToRawPacket()
 		if err != nil {
 			log.Errorf("Unable to encode initial packet: %s", err.Error())
 			conn.Close()
+			upconn.Close()
+			sessionEnd(upstream.Server)
 			return
 		}
 		login_raw, err = login_pkt.ToRawPacket()
 		if err != nil {
 			log.Errorf("Unable to encode login packet: %s", err.Error())
 			conn.Close()
+			upconn.Close()
+			sessionEnd(upstream.Server)
 			return
 		}
 		_, err = upconn.Write(init_raw.ToBytes())
@@ -272,12 +308,16 @@ func proxy(conn *WrapedSocket, upstream *Upstream, initial_pkt *mcproto.MCHandSh
 			upconn.Errorf("write error: %s", err.Error())
 		}
 		spe := new(StartProxyEvent)
-		spe.Upstream = upstream
+		spe.Upstream = routed
 		spe.NetworkEvent = ne.NetworkEvent
 		spe.InitPacket = initial_pkt
 		spe.LoginPacket = login_pkt
 		StartProxy(spe)
-		go PipeIt(conn, upconn)
+		go func(server string) {
+			// Ends when client is gone, or closed by the other pipe.
+			PipeIt(conn, upconn)
+			sessionEnd(server)
+		}(upstream.Server)
 		go PipeIt(upconn, conn)
 	}
 }
@@ -354,12 +394,37 @@ func ClientSocket(conn *WrapedSocket, ne *PostAcceptEvent) {
 		e.SetBold(true)
 		RejectHandler(conn, handshake, e)
 	} else {
-		upstream, e := GetUpstream(handshake.ServerAddr)
-		if e != nil {
-			RejectHandler(conn, handshake, e)
+		upstream := pre.Upstream
+		if upstream != nil {
+			conn.Infof("upstream %s chosen by plugin", upstream.Server)
+		} else {
+			var e *mcchat.ChatMsg
+			upstream, e = RouteUpstream(&RouteRequest{
+				Hostname:   handshake.ServerAddr,
+				Port:       handshake.ServerPort,
+				Proto:      handshake.Proto,
+				RemoteAddr: ne.RemoteAddr,
+			})
+			if e != nil {
+				rejectNotFound(conn, handshake, e)
+				return
+			}
+		}
+		// Code is removed from hostname if valid, and counted on login.
+		code, err := upstream.checkJoinCode(handshake)
+		if err != nil {
+			conn.Warnf("%s for %s", err.Error(), upstream.Server)
+			if handshake.NextState == 1 {
+				config_lock.Lock()
+				e := config.chatNotFound
+				config_lock.Unlock()
+				rejectNotFound(conn, handshake, e)
+			} else {
+				RejectHandler(conn, handshake, upstream.JoinCodes.kick)
+			}
 			return
 		}
-		proxy(conn, upstream, handshake, ne)
+		proxy(conn, upstream, handshake, ne, code)
 	}
 
 }
@@ -28,6 +28,8 @@ type PreRoutingEvent struct {
 	NetworkEvent
 	RejectPoint
 	Packet *mcproto.MCHandShake
+	// Set by plugins to skip routing and use this upstream.
+	Upstream *Upstream
 }
 
 type PingRequestEvent struct {
@@ -42,7 +44,8 @@ type LoginRequestEvent struct {
 	RejectPoint
 	InitPacket  *mcproto.MCHandShake
 	LoginPacket *mcproto.MCLogin
-	Upstream    *Upstream
+	// May be replaced by plugins, connection is made to the final one.
+	Upstream *Upstream
 }
 
 type StartProxyEvent struct {
@@ -54,8 +57,12 @@ type StartProxyEvent struct {
 
 type PreStatusResponseEvent struct {
 	NetworkEvent
-	Packet   *mcproto.MCStatusResponse
-	Upstream *Upstream
+	// Handshake sent by client.
+	InitPacket *mcproto.MCHandShake
+	Packet     *mcproto.MCStatusResponse
+	Upstream   *Upstream
+	// Set if status of upstream is unavailable, Packet has its error message.
+	Err error
 }
 
 type DisconnectEvent struct {
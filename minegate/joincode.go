@@ -0,0 +1,190 @@
+package minegate
+
+import (
+	"errors"
+	"github.com/jackyyf/MineGate-Go/mcchat"
+	"github.com/jackyyf/MineGate-Go/mcproto"
+	log "github.com/jackyyf/golog"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+)
+
+// JoinCodeOptions requires the first label of hostname typed by client to be
+// a valid join code, like abc123.event.example.com (matched by a rule like
+// *.event.example.com). Codes are listed in codes or file (same format,
+// loaded with config), and may be added at runtime with AddJoinCode. The code
+// label is removed from the handshake sent to upstream. Players with invalid
+// codes are kicked with kick, pings look like those of unknown hosts.
+type JoinCodeOptions struct {
+	Codes []*JoinCode `yaml:"codes"`
+	File  string      `yaml:"file"`
+	Kick  ChatMessage `yaml:"kick"`
+	codes map[string]*JoinCode
+	kick  *mcchat.ChatMsg
+}
+
+// JoinCode expires at given time (RFC 3339 or "2006-01-02 15:04" in local
+// time), after being used max_uses times. Zero values mean no limit.
+type JoinCode struct {
+	Code    string `yaml:"code"`
+	Expires string `yaml:"expires"`
+	MaxUses uint   `yaml:"max_uses"`
+	expires time.Time
+}
+
+// Codes added at runtime and uses of codes, by upstream name (or server if
+// unnamed) and code, kept across config reloads.
+var join_codes_lock sync.Mutex
+var join_codes_added = make(map[string]map[string]*JoinCode)
+var join_code_uses = make(map[string]uint)
+
+const join_code_msg = "Invalid or expired join code."
+
+func (code *JoinCode) Validate() (valid bool) {
+	code.Code = strings.ToLower(strings.TrimSpace(code.Code))
+	if code.Code == "" || strings.Contains(code.Code, ".") {
+		log.Errorf("Invalid join code %s", code.Code)
+		return false
+	}
+	if code.Expires == "" {
+		return true
+	}
+	var err error
+	if code.expires, err = time.Parse(time.RFC3339, code.Expires); err != nil {
+		if code.expires, err = time.ParseInLocation("2006-01-02 15:04", code.Expires, time.Local); err != nil {
+			log.Errorf("Invalid expire time %s of join code %s", code.Expires, code.Code)
+			return false
+		}
+	}
+	return true
+}
+
+func (options *JoinCodeOptions) Validate() (valid bool) {
+	codes := options.Codes
+	if options.File != "" {
+		content, err := ioutil.ReadFile(options.File)
+		if err != nil {
+			log.Errorf("Unable to read join codes from %s: %s", options.File, err.Error())
+			return false
+		}
+		var loaded []*JoinCode
+		if err = yaml.Unmarshal(content, &loaded); err != nil {
+			log.Errorf("Invalid join codes in %s: %s", options.File, err.Error())
+			return false
+		}
+		codes = append(codes, loaded...)
+	}
+	options.codes = make(map[string]*JoinCode, len(codes))
+	for _, code := range codes {
+		if !code.Validate() {
+			return false
+		}
+		options.codes[code.Code] = code
+	}
+	if options.Kick.Text == "" {
+		options.Kick.Text = join_code_msg
+	}
+	options.kick = ToChatMsg(&options.Kick)
+	return true
+}
+
+// splitJoinCode splits the first label of hostname in handshake.
+func splitJoinCode(addr string) (code, rest string) {
+	host, extra := addr, ""
+	if idx := strings.IndexByte(host, 0); idx != -1 {
+		host, extra = host[:idx], host[idx:]
+	}
+	idx := strings.IndexByte(host, '.')
+	if idx == -1 {
+		return "", addr
+	}
+	return strings.ToLower(host[:idx]), host[idx+1:] + extra
+}
+
+// joinCodeUse is a valid join code, counted once the login succeeds.
+type joinCodeUse struct {
+	upstream *Upstream
+	code     string
+}
+
+// lookupJoinCode checks join code of upstream, and counts a use of it if use
+// is set.
+func (upstream *Upstream) lookupJoinCode(code string, use bool) (err error) {
+	key := upstream.maintenanceKey()
+	join_codes_lock.Lock()
+	defer join_codes_lock.Unlock()
+	found := join_codes_added[key][code]
+	if found == nil {
+		found = upstream.JoinCodes.codes[code]
+	}
+	if found == nil {
+		return errors.New("unknown join code " + code)
+	}
+	if !found.expires.IsZero() && !time.Now().Before(found.expires) {
+		return errors.New("expired join code " + code)
+	}
+	uses_key := key + "/" + code
+	if found.MaxUses != 0 && join_code_uses[uses_key] >= found.MaxUses {
+		return errors.New("used up join code " + code)
+	}
+	if use {
+		join_code_uses[uses_key]++
+	}
+	return nil
+}
+
+// checkJoinCode checks join code in hostname of handshake, which is removed
+// if valid. The use is not counted until commit is called.
+func (upstream *Upstream) checkJoinCode(handshake *mcproto.MCHandShake) (use *joinCodeUse, err error) {
+	if upstream.JoinCodes == nil {
+		return nil, nil
+	}
+	code, rest := splitJoinCode(handshake.ServerAddr)
+	if code == "" {
+		return nil, errors.New("no join code")
+	}
+	if err = upstream.lookupJoinCode(code, false); err != nil {
+		return nil, err
+	}
+	handshake.ServerAddr = rest
+	return &joinCodeUse{upstream, code}, nil
+}
+
+// commit counts the use, which fails if the code is used up or has expired
+// meanwhile. Nil use is always committed.
+func (use *joinCodeUse) commit() (err error) {
+	if use == nil {
+		return nil
+	}
+	return use.upstream.lookupJoinCode(use.code, true)
+}
+
+// AddJoinCode adds (or replaces) a join code of upstream (by name, or server
+// if unnamed) at runtime, with uses reset.
+func AddJoinCode(key string, code *JoinCode) error {
+	if !code.Validate() {
+		return errors.New("invalid join code")
+	}
+	join_codes_lock.Lock()
+	if join_codes_added[key] == nil {
+		join_codes_added[key] = make(map[string]*JoinCode)
+	}
+	join_codes_added[key][code.Code] = code
+	delete(join_code_uses, key+"/"+code.Code)
+	join_codes_lock.Unlock()
+	log.Infof("Join code %s added to %s", code.Code, key)
+	return nil
+}
+
+// RemoveJoinCode removes a join code added at runtime.
+func RemoveJoinCode(key, code string) {
+	code = strings.ToLower(code)
+	join_codes_lock.Lock()
+	delete(join_codes_added[key], code)
+	delete(join_code_uses, key+"/"+code)
+	join_codes_lock.Unlock()
+	log.Infof("Join code %s removed from %s", code, key)
+}
@@ -0,0 +1,179 @@
+package minegate
+
+import (
+	"bufio"
+	"github.com/jackyyf/MineGate-Go/mcproto"
+	log "github.com/jackyyf/golog"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestJoinCode(t *testing.T) {
+	defer func() {
+		if r := recover(); r != nil {
+			t.Fatalf("Recovered from panic: %s", r)
+			return
+		}
+	}()
+	defer os.Remove("joincode.yml")
+	defer os.Remove("joincode_codes.yml")
+	log.SetLogLevel(log.FATAL)
+	// Uses are kept across config reloads, so also across runs of this test.
+	join_codes_lock.Lock()
+	join_codes_added = make(map[string]map[string]*JoinCode)
+	join_code_uses = make(map[string]uint)
+	join_codes_lock.Unlock()
+	if err := ioutil.WriteFile("joincode_codes.yml", []byte(
+		`
+- code: FromFile
+  max_uses: 1`), 0644); err != nil {
+		t.Fatal("Unable to write to joincode_codes.yml")
+		return
+	}
+	if err := ioutil.WriteFile("joincode.yml", []byte(
+		`
+listen: ':25565'
+upstreams:
+- name: event
+  hostname: '*.event.example.com'
+  upstream: 127.0.0.1:25593
+  join_codes:
+    file: joincode_codes.yml
+    kick:
+      text: Ask an organizer for a new code.
+    codes:
+    - code: abc123
+      max_uses: 2
+    - code: old
+      expires: 2000-01-01T00:00:00Z
+    - code: later
+      expires: '2999-01-01 00:00'`), 0644); err != nil {
+		t.Fatal("Unable to write to joincode.yml")
+		return
+	}
+	SetConfig("joincode.yml")
+	confInit()
+	event, _ := MatchUpstream("abc123.event.example.com")
+	if event == nil || event.JoinCodes == nil {
+		t.Fatal("Upstream not found")
+		return
+	}
+	if event.JoinCodes.kick.Text != "Ask an organizer for a new code." {
+		t.Errorf("Invalid kick message: %s", event.JoinCodes.kick.Text)
+	}
+	check := func(addr string, use bool) (string, error) {
+		handshake := &mcproto.MCHandShake{Proto: 47, ServerAddr: addr, ServerPort: 25565, NextState: 2}
+		code, err := event.checkJoinCode(handshake)
+		if err == nil && use {
+			err = code.commit()
+		}
+		return handshake.ServerAddr, err
+	}
+	if addr, err := check("ABC123.event.example.com\x00FML\x00", false); err != nil || addr != "event.example.com\x00FML\x00" {
+		t.Errorf("Code label should be removed: %q, %v", addr, err)
+	}
+	for idx := 0; idx < 2; idx++ {
+		if _, err := check("abc123.event.example.com", true); err != nil {
+			t.Errorf("abc123 should be valid for 2 uses: %s", err.Error())
+		}
+	}
+	if addr, err := check("abc123.event.example.com", true); err == nil || addr != "abc123.event.example.com" {
+		t.Error("abc123 should be used up")
+	}
+	for _, addr := range []string{"old.event.example.com", "nope.event.example.com", "localhost"} {
+		if _, err := check(addr, false); err == nil {
+			t.Errorf("%s should be rejected", addr)
+		}
+	}
+	if _, err := check("later.event.example.com", true); err != nil {
+		t.Errorf("later should be valid: %s", err.Error())
+	}
+	if _, err := check("fromfile.event.example.com", true); err != nil {
+		t.Errorf("Code from file should be valid: %s", err.Error())
+	}
+	if err := AddJoinCode("event", &JoinCode{Code: "vip", Expires: time.Now().Add(time.Hour).Format(time.RFC3339)}); err != nil {
+		t.Errorf("Unable to add join code: %s", err.Error())
+	}
+	// Uses and runtime codes are kept across reloads.
+	ConfReload()
+	event, _ = MatchUpstream("vip.event.example.com")
+	if _, err := check("vip.event.example.com", true); err != nil {
+		t.Errorf("vip should be valid: %s", err.Error())
+	}
+	if _, err := check("abc123.event.example.com", true); err == nil {
+		t.Error("abc123 should be used up after reload")
+	}
+	RemoveJoinCode("event", "VIP")
+	if _, err := check("vip.event.example.com", true); err == nil {
+		t.Error("vip should be removed")
+	}
+
+	// Uses are counted only when login gets to upstream.
+	AddJoinCode("event", &JoinCode{Code: "once", MaxUses: 1})
+	login := func(upstream *Upstream) (pkt *mcproto.RAWPacket, err error) {
+		server, peer := net.Pipe()
+		defer peer.Close()
+		handshake := &mcproto.MCHandShake{Proto: 47, ServerAddr: "once.event.example.com", ServerPort: 25565, NextState: 2}
+		code, err := upstream.checkJoinCode(handshake)
+		if err != nil {
+			return nil, err
+		}
+		ne := new(PostAcceptEvent)
+		ne.RemoteAddr = &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 50000}
+		go proxy(WrapClientSocket(server), upstream, handshake, ne, code)
+		raw, _ := (&mcproto.MCLogin{Name: "Steve"}).ToRawPacket()
+		peer.Write(raw.ToBytes())
+		reader := bufio.NewReader(peer)
+		pkt, err = mcproto.ReadPacket(reader)
+		// Connection is closed once upstream is gone.
+		peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+		io.Copy(ioutil.Discard, reader)
+		return
+	}
+	// Nothing listens on upstream of event.
+	if pkt, err := login(event); err != nil || pkt.ID != 0 {
+		t.Errorf("Login should be kicked when upstream is down: %+v, %v", pkt, err)
+	}
+	if _, err := check("once.event.example.com", false); err != nil {
+		t.Errorf("Rejected login should not use join code: %s", err.Error())
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err.Error())
+		return
+	}
+	defer listener.Close()
+	go func() {
+		sock, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer sock.Close()
+		reader := bufio.NewReader(sock)
+		mcproto.ReadPacket(reader)
+		mcproto.ReadPacket(reader)
+		kick, _ := (&mcproto.MCKick{Text: "Welcome"}).ToRawPacket()
+		sock.Write(kick.ToBytes())
+	}()
+	up := *event
+	up.Server = listener.Addr().String()
+	if pkt, err := login(&up); err != nil {
+		t.Errorf("Login should reach upstream: %v", err)
+	} else if kick, _ := pkt.ToKick(); kick == nil || kick.Text != "Welcome" {
+		t.Errorf("Packet from upstream expected, %+v found", kick)
+	}
+	// Wait for pipes to end.
+	for idx := 0; idx < 100 && OnlineCount(up.Server) != 0; idx++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := check("once.event.example.com", false); err == nil {
+		t.Error("once should be used up after login")
+	}
+	if !t.Failed() {
+		t.Log("Ok, join codes checked.")
+	}
+}
@@ -0,0 +1,128 @@
+package minegate
+
+import (
+	"bufio"
+	log "github.com/jackyyf/golog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Files beyond this are read on each use, and not watched.
+const max_list_files = 1024
+
+// ListFiles loads list files for a plugin, with one entry per line, # starts
+// a comment. Entries are parsed by parse, files are loaded on first use and
+// reloaded when modified. Files failing to load keep their previous entries.
+type ListFiles struct {
+	name  string
+	parse func(file string, entries []string) interface{}
+	lock  sync.Mutex
+	// Held when opening files, so those replaced are always unwatched.
+	load_lock sync.Mutex
+	files     map[string]*listFile
+}
+
+type listFile struct {
+	value interface{}
+	stop  func()
+}
+
+func NewListFiles(name string, parse func(file string, entries []string) interface{}) *ListFiles {
+	return &ListFiles{name: name, parse: parse, files: make(map[string]*listFile)}
+}
+
+func readList(file string) (entries []string, err error) {
+	fp, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	scanner := bufio.NewScanner(fp)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if idx := strings.IndexByte(line, '#'); idx != -1 {
+			line = line[:idx]
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			entries = append(entries, line)
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func (lists *ListFiles) load(list *listFile, file string) {
+	entries, err := readList(file)
+	if err != nil {
+		log.Errorf("[%s] unable to load %s: %s", lists.name, file, err.Error())
+		return
+	}
+	value := lists.parse(file, entries)
+	lists.lock.Lock()
+	list.value = value
+	lists.lock.Unlock()
+	log.Infof("[%s] %d entries loaded from %s", lists.name, len(entries), file)
+}
+
+// open loads and watches file. Must be called with load_lock held.
+func (lists *ListFiles) open(file string) (list *listFile) {
+	list = new(listFile)
+	list.stop = WatchFile(file, 5*time.Second, func() {
+		lists.load(list, file)
+	})
+	lists.load(list, file)
+	return
+}
+
+// Load reloads files, and stops watching those not listed.
+func (lists *ListFiles) Load(files []string) {
+	lists.load_lock.Lock()
+	defer lists.load_lock.Unlock()
+	loaded := make(map[string]*listFile)
+	for _, file := range files {
+		if loaded[file] == nil {
+			loaded[file] = lists.open(file)
+		}
+	}
+	lists.lock.Lock()
+	old := lists.files
+	lists.files = loaded
+	lists.lock.Unlock()
+	for _, list := range old {
+		list.stop()
+	}
+}
+
+// Get returns parsed entries of file, nil if it can't be loaded.
+func (lists *ListFiles) Get(file string) interface{} {
+	lists.lock.Lock()
+	if list := lists.files[file]; list != nil {
+		defer lists.lock.Unlock()
+		return list.value
+	}
+	lists.lock.Unlock()
+	lists.load_lock.Lock()
+	defer lists.load_lock.Unlock()
+	lists.lock.Lock()
+	list := lists.files[file]
+	count := len(lists.files)
+	lists.lock.Unlock()
+	if list == nil && count >= max_list_files {
+		list = new(listFile)
+		lists.load(list, file)
+		return list.value
+	}
+	if list == nil {
+		list = lists.open(file)
+		lists.lock.Lock()
+		lists.files[file] = list
+		lists.lock.Unlock()
+	}
+	lists.lock.Lock()
+	defer lists.lock.Unlock()
+	return list.value
+}
@@ -0,0 +1,49 @@
+package minegate
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestListFiles(t *testing.T) {
+	defer func() {
+		if r := recover(); r != nil {
+			t.Fatalf("Recovered from panic: %s", r)
+			return
+		}
+	}()
+	dir, err := ioutil.TempDir("", "listfile")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "list.txt")
+	if err = ioutil.WriteFile(file, []byte("# list\nalpha\n  beta  # second\n\n"), 0644); err != nil {
+		t.Fatalf("Unable to write %s: %s", file, err.Error())
+	}
+	parsed := 0
+	lists := NewListFiles("test", func(file string, entries []string) interface{} {
+		parsed++
+		return strings.Join(entries, ",")
+	})
+	defer lists.Load(nil)
+	if val := lists.Get(file); val != "alpha,beta" {
+		t.Errorf("%v loaded from %s, alpha,beta expected", val, file)
+	}
+	lists.Get(file)
+	if parsed != 1 {
+		t.Errorf("%s parsed %d times, once expected", file, parsed)
+	}
+	if val := lists.Get(filepath.Join(dir, "missing.txt")); val != nil {
+		t.Errorf("%v loaded from missing file", val)
+	}
+	ioutil.WriteFile(file, []byte("gamma\n"), 0644)
+	lists.Load([]string{file})
+	if val := lists.Get(file); val != "gamma" {
+		t.Errorf("%v loaded from %s, gamma expected after reload", val, file)
+	}
+	t.Log("Ok, list files loaded once and reloaded with config.")
+}
@@ -0,0 +1,129 @@
+package minegate
+
+import (
+	"github.com/jackyyf/MineGate-Go/mcchat"
+	"github.com/jackyyf/MineGate-Go/mcproto"
+	log "github.com/jackyyf/golog"
+	"net"
+	"strings"
+	"sync"
+)
+
+// MaintenanceOptions makes upstream answer pings with motd and version label,
+// and kick players logging in, except those in bypass (player names, IPs or
+// networks). Clients from bypass addresses see status of upstream as usual.
+type MaintenanceOptions struct {
+	Enabled  bool        `yaml:"enabled"`
+	MOTD     ChatMessage `yaml:"motd"`
+	Version  string      `yaml:"version"`
+	Kick     ChatMessage `yaml:"kick"`
+	Bypass   StringList  `yaml:"bypass"`
+	motd     *mcchat.ChatMsg
+	kick     *mcchat.ChatMsg
+	names    map[string]bool
+	networks []*net.IPNet
+}
+
+// Maintenance mode set at runtime, by upstream name (or server if unnamed),
+// kept across config reloads.
+var maintenance_lock sync.Mutex
+var maintenance_overrides = make(map[string]bool)
+
+const maintenance_msg = "Server is under maintenance."
+
+func (maintenance *MaintenanceOptions) Validate() (valid bool) {
+	if maintenance.MOTD.Text == "" {
+		maintenance.MOTD.Text = maintenance_msg
+	}
+	if maintenance.Kick.Text == "" {
+		maintenance.Kick.Text = maintenance.MOTD.Text
+	}
+	if maintenance.Version == "" {
+		maintenance.Version = "Maintenance"
+	}
+	maintenance.motd = ToChatMsg(&maintenance.MOTD)
+	maintenance.kick = ToChatMsg(&maintenance.Kick)
+	maintenance.names = make(map[string]bool)
+	var addrs StringList
+	for _, entry := range maintenance.Bypass {
+		entry = strings.TrimSpace(entry)
+		if strings.Contains(entry, "/") || net.ParseIP(entry) != nil {
+			addrs = append(addrs, entry)
+		} else {
+			maintenance.names[strings.ToLower(entry)] = true
+		}
+	}
+	var err error
+	if maintenance.networks, err = ParseCIDRList(addrs); err != nil {
+		log.Errorf("Invalid maintenance bypass: %s", err.Error())
+		return false
+	}
+	return true
+}
+
+// Bypassed reports whether client from addr, logging in as name (empty for
+// pings), bypasses maintenance mode.
+func (maintenance *MaintenanceOptions) Bypassed(addr *net.TCPAddr, name string) bool {
+	if name != "" && maintenance.names[strings.ToLower(name)] {
+		return true
+	}
+	return addr != nil && InNetworks(addr.IP, maintenance.networks)
+}
+
+func (maintenance *MaintenanceOptions) status() (resp *mcproto.MCStatusResponse) {
+	resp = new(mcproto.MCStatusResponse)
+	resp.Version.Name = maintenance.Version
+	// Always incompatible, so the label is shown.
+	resp.Version.Protocol = -1
+	if maintenance.motd == nil {
+		resp.Description = mcchat.NewMsg(maintenance_msg)
+	} else {
+		motd := *maintenance.motd
+		resp.Description = &motd
+	}
+	return
+}
+
+func (maintenance *MaintenanceOptions) kickMsg() *mcchat.ChatMsg {
+	if maintenance.kick == nil {
+		return mcchat.NewMsg(maintenance_msg)
+	}
+	return maintenance.kick
+}
+
+func (upstream *Upstream) maintenanceKey() string {
+	if upstream.Name != "" {
+		return upstream.Name
+	}
+	return upstream.Server
+}
+
+// InMaintenance reports whether upstream is in maintenance mode, set at
+// runtime or in config.
+func (upstream *Upstream) InMaintenance() bool {
+	maintenance_lock.Lock()
+	enabled, ok := maintenance_overrides[upstream.maintenanceKey()]
+	maintenance_lock.Unlock()
+	if ok {
+		return enabled
+	}
+	return upstream.Maintenance.Enabled
+}
+
+// SetMaintenance turns maintenance mode of upstream on or off, key is name of
+// upstream, or server address if it's unnamed. It overrides config until
+// ResetMaintenance is called.
+func SetMaintenance(key string, enabled bool) {
+	maintenance_lock.Lock()
+	maintenance_overrides[key] = enabled
+	maintenance_lock.Unlock()
+	log.Infof("Maintenance mode of %s set to %t", key, enabled)
+}
+
+// ResetMaintenance makes maintenance mode of upstream follow config again.
+func ResetMaintenance(key string) {
+	maintenance_lock.Lock()
+	delete(maintenance_overrides, key)
+	maintenance_lock.Unlock()
+	log.Infof("Maintenance mode of %s follows config.", key)
+}
@@ -0,0 +1,125 @@
+package minegate
+
+import (
+	"bufio"
+	"github.com/jackyyf/MineGate-Go/mcproto"
+	log "github.com/jackyyf/golog"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestMaintenance(t *testing.T) {
+	defer func() {
+		if r := recover(); r != nil {
+			t.Fatalf("Recovered from panic: %s", r)
+			return
+		}
+	}()
+	defer os.Remove("maintenance.yml")
+	log.SetLogLevel(log.FATAL)
+	if err := ioutil.WriteFile("maintenance.yml", []byte(
+		`
+listen: ':25565'
+registry:
+  token: secret
+upstreams:
+- name: survival
+  hostname: survival.example.com
+  upstream: 127.0.0.1:1
+  maintenance:
+    enabled: true
+    motd:
+      text: Back soon
+      color: red
+    version: Upgrading
+    kick:
+      text: Upgrading to 1.20
+    bypass: [Notch, 10.0.0.0/8, '::1']
+- hostname: creative.example.com
+  upstream: 127.0.0.1:2`), 0644); err != nil {
+		t.Fatal("Unable to write to maintenance.yml")
+		return
+	}
+	SetConfig("maintenance.yml")
+	confInit()
+	survival, _ := MatchUpstream("survival.example.com")
+	creative, _ := MatchUpstream("creative.example.com")
+	if survival == nil || creative == nil {
+		t.Fatal("Upstreams not found")
+		return
+	}
+	if !survival.InMaintenance() || creative.InMaintenance() {
+		t.Error("Only survival should be in maintenance")
+	}
+	client := &net.TCPAddr{IP: net.ParseIP("192.168.1.2"), Port: 40000}
+	if survival.Maintenance.Bypassed(client, "") || survival.Maintenance.Bypassed(client, "Steve") {
+		t.Error("192.168.1.2 (Steve) should not bypass maintenance")
+	}
+	if !survival.Maintenance.Bypassed(client, "notch") {
+		t.Error("notch should bypass maintenance")
+	}
+	if !survival.Maintenance.Bypassed(&net.TCPAddr{IP: net.ParseIP("::ffff:10.1.2.3")}, "") ||
+		!survival.Maintenance.Bypassed(&net.TCPAddr{IP: net.IPv6loopback}, "") {
+		t.Error("10.1.2.3 and ::1 should bypass maintenance")
+	}
+	resp := survival.Maintenance.status()
+	if resp.Version.Name != "Upgrading" || resp.Version.Protocol != -1 || resp.Description.Text != "Back soon" {
+		t.Errorf("Invalid maintenance status: %+v", resp)
+	}
+
+	// Login is kicked without dialing upstream.
+	server, peer := net.Pipe()
+	defer peer.Close()
+	handshake := &mcproto.MCHandShake{Proto: 47, ServerAddr: "survival.example.com", ServerPort: 25565, NextState: 2}
+	ne := new(PostAcceptEvent)
+	ne.RemoteAddr = client
+	go proxy(WrapClientSocket(server), survival, handshake, ne, nil)
+	login, _ := (&mcproto.MCLogin{Name: "Steve"}).ToRawPacket()
+	peer.Write(login.ToBytes())
+	pkt, err := mcproto.ReadPacket(bufio.NewReader(peer))
+	if err != nil {
+		t.Fatalf("Unable to read kick packet: %s", err.Error())
+		return
+	}
+	if kick, err := pkt.ToKick(); err != nil || kick.Text != "Upgrading to 1.20" {
+		t.Errorf("Player should be kicked for maintenance: %+v", kick)
+	}
+
+	api := httptest.NewServer(registryAPI{})
+	defer api.Close()
+	request := func(method, path string) int {
+		req, _ := http.NewRequest(method, api.URL+path, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %s", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := request("POST", "/maintenance?name=survival&enabled=false"); code != http.StatusOK {
+		t.Errorf("Unable to turn off maintenance: %d", code)
+	}
+	SetMaintenance("127.0.0.1:2", true)
+	// Runtime settings are kept across reloads.
+	ConfReload()
+	survival, _ = MatchUpstream("survival.example.com")
+	creative, _ = MatchUpstream("creative.example.com")
+	if survival.InMaintenance() || !creative.InMaintenance() {
+		t.Error("Maintenance mode should be switched at runtime")
+	}
+	if code := request("DELETE", "/maintenance?name=survival"); code != http.StatusOK {
+		t.Errorf("Unable to reset maintenance: %d", code)
+	}
+	ResetMaintenance("127.0.0.1:2")
+	if !survival.InMaintenance() || creative.InMaintenance() {
+		t.Error("Maintenance mode should follow config after reset")
+	}
+	if !t.Failed() {
+		t.Log("Ok, maintenance mode works.")
+	}
+}
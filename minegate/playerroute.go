@@ -0,0 +1,115 @@
+package minegate
+
+import (
+	"encoding/hex"
+	"github.com/jackyyf/MineGate-Go/mcproto"
+	log "github.com/jackyyf/golog"
+	yaml "gopkg.in/yaml.v2"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Per player routing overrides are loaded from the file set by player_routes,
+// which maps player name or UUID to upstream name or address:
+//
+//   Notch: staff
+//   069a79f4-44e9-4726-a5be-fca90e38aaf5: staff
+//   tester: 127.0.0.1:25580
+//
+// The file is reloaded on SIGHUP, and when it's modified.
+
+var player_routes_lock sync.Mutex
+var player_routes map[string]string
+var player_routes_file string
+var player_routes_stop func()
+
+func playerKey(key string) string {
+	key = strings.ToLower(strings.TrimSpace(key))
+	if uuid := strings.Replace(key, "-", "", -1); len(uuid) == 32 {
+		if _, err := hex.DecodeString(uuid); err == nil {
+			return uuid
+		}
+	}
+	return key
+}
+
+func loadPlayerRoutes() {
+	player_routes_lock.Lock()
+	file := player_routes_file
+	player_routes_lock.Unlock()
+	if file == "" {
+		return
+	}
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		log.Errorf("unable to load player routes %s: %s", file, err.Error())
+		return
+	}
+	var raw map[string]string
+	if err = yaml.Unmarshal(content, &raw); err != nil {
+		log.Errorf("error when parsing player routes %s: %s", file, err.Error())
+		return
+	}
+	routes := make(map[string]string, len(raw))
+	for player, target := range raw {
+		routes[playerKey(player)] = strings.TrimSpace(target)
+	}
+	player_routes_lock.Lock()
+	player_routes = routes
+	player_routes_lock.Unlock()
+	log.Infof("%d player route(s) loaded from %s", len(routes), file)
+}
+
+func setPlayerRoutesFile(file string) {
+	if file != "" {
+		file, _ = filepath.Abs(file)
+	}
+	player_routes_lock.Lock()
+	if player_routes_stop != nil {
+		player_routes_stop()
+		player_routes_stop = nil
+	}
+	player_routes_file = file
+	if file == "" {
+		player_routes = nil
+	}
+	player_routes_lock.Unlock()
+	if file == "" {
+		return
+	}
+	loadPlayerRoutes()
+	stop := WatchFile(file, 5*time.Second, loadPlayerRoutes)
+	player_routes_lock.Lock()
+	player_routes_stop = stop
+	player_routes_lock.Unlock()
+}
+
+// RoutePlayer applies per player routing override after Login Start. The
+// original upstream is returned if there's no override for the player.
+func RoutePlayer(upstream *Upstream, login *mcproto.MCLogin) (res *Upstream, overridden bool) {
+	uuid, ok := login.PlayerUUID()
+	if !ok {
+		uuid = OfflineUUID(login.Name)
+	}
+	player_routes_lock.Lock()
+	target, found := player_routes[playerKey(uuid)]
+	if !found {
+		target, found = player_routes[playerKey(login.Name)]
+	}
+	player_routes_lock.Unlock()
+	if !found || target == "" {
+		return upstream, false
+	}
+	if named := FindUpstream(target); named != nil {
+		return named, true
+	}
+	res, err := upstream.WithServer(target)
+	if err != nil {
+		log.Errorf("Invalid player route %s for %s: %s", target, login.Name, err.Error())
+		return upstream, false
+	}
+	return res, true
+}
@@ -0,0 +1,233 @@
+package minegate
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/jackyyf/golog"
+	yaml "gopkg.in/yaml.v2"
+	"net"
+	"sync"
+	"time"
+)
+
+// RouteProvider finds the upstream for a routing request. Returning nil
+// upstream and nil error means the provider knows nothing about the request,
+// and the next provider is consulted.
+type RouteProvider interface {
+	Name() string
+	Lookup(req *RouteRequest) (upstream *Upstream, err error)
+}
+
+// CacheKeyProvider is implemented by providers which know what their results
+// depend on. CacheKey returns key of the result for request in cache, or
+// false if it shouldn't be cached. Results of other providers are cached by
+// hostname, port, protocol and client address.
+type CacheKeyProvider interface {
+	CacheKey(req *RouteRequest) (key string, ok bool)
+}
+
+// providerStopper is implemented by providers with background work (like
+// watching files), stopped when providers are rebuilt.
+type providerStopper interface {
+	stop()
+}
+
+// RouteProviderFactory creates a provider from its config entry in
+// route_providers.
+type RouteProviderFactory func(options map[string]interface{}) (RouteProvider, error)
+
+var provider_factories = make(map[string]RouteProviderFactory)
+
+var provider_lock sync.Mutex
+
+// RegisterRouteProvider makes a provider type usable in route_providers, it
+// should be called by plugins in init.
+func RegisterRouteProvider(kind string, factory RouteProviderFactory) (err error) {
+	if factory == nil {
+		log.Error("Attempt to register nil route provider")
+		return errors.New("Nil factory!")
+	}
+	provider_lock.Lock()
+	defer provider_lock.Unlock()
+	if _, ok := provider_factories[kind]; ok {
+		log.Errorf("Route provider %s already registered", kind)
+		return fmt.Errorf("route provider %s already registered", kind)
+	}
+	provider_factories[kind] = factory
+	log.Infof("Registered route provider %s", kind)
+	return nil
+}
+
+// The upstreams list in config.
+type staticProvider struct{}
+
+func (staticProvider) Name() string {
+	return "static"
+}
+
+func (staticProvider) Lookup(req *RouteRequest) (upstream *Upstream, err error) {
+	upstream, _ = matchStatic(req)
+	return upstream, nil
+}
+
+type routeCacheEntry struct {
+	upstream *Upstream
+	expire   time.Time
+}
+
+// cachedProvider caches results of provider by request, not found results
+// are cached with negative_ttl. Errors are not cached.
+type cachedProvider struct {
+	provider     RouteProvider
+	ttl          time.Duration
+	negative_ttl time.Duration
+	lock         sync.Mutex
+	entries      map[string]routeCacheEntry
+}
+
+const route_cache_sweep = 4096
+
+func newCachedProvider(provider RouteProvider, ttl, negative_ttl time.Duration) *cachedProvider {
+	return &cachedProvider{
+		provider:     provider,
+		ttl:          ttl,
+		negative_ttl: negative_ttl,
+		entries:      make(map[string]routeCacheEntry),
+	}
+}
+
+func (cache *cachedProvider) Name() string {
+	return cache.provider.Name()
+}
+
+func (cache *cachedProvider) stop() {
+	if provider, ok := cache.provider.(providerStopper); ok {
+		provider.stop()
+	}
+}
+
+func (cache *cachedProvider) key(req *RouteRequest) (key string, ok bool) {
+	if provider, ok := cache.provider.(CacheKeyProvider); ok {
+		return provider.CacheKey(req)
+	}
+	var ip net.IP
+	if req.RemoteAddr != nil {
+		ip = req.RemoteAddr.IP
+	}
+	return fmt.Sprintf("%s:%d/%d/%s", NormalizeHost(req.Hostname), req.Port, req.Proto, ip), true
+}
+
+func (cache *cachedProvider) Lookup(req *RouteRequest) (upstream *Upstream, err error) {
+	key, cacheable := cache.key(req)
+	if !cacheable {
+		return cache.provider.Lookup(req)
+	}
+	now := time.Now()
+	cache.lock.Lock()
+	entry, ok := cache.entries[key]
+	cache.lock.Unlock()
+	if ok && now.Before(entry.expire) {
+		return entry.upstream, nil
+	}
+	upstream, err = cache.provider.Lookup(req)
+	if err != nil {
+		return nil, err
+	}
+	ttl := cache.ttl
+	if upstream == nil {
+		ttl = cache.negative_ttl
+	}
+	if ttl <= 0 {
+		return
+	}
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	if len(cache.entries) >= route_cache_sweep {
+		for old, entry := range cache.entries {
+			if now.After(entry.expire) {
+				delete(cache.entries, old)
+			}
+		}
+		if len(cache.entries) >= route_cache_sweep {
+			cache.entries = make(map[string]routeCacheEntry)
+		}
+	}
+	cache.entries[key] = routeCacheEntry{
+		upstream: upstream,
+		expire:   now.Add(ttl),
+	}
+	return
+}
+
+// decodeUpstream builds upstream from a provider result, either an address
+// string or an object in the same format as entries of upstreams.
+func decodeUpstream(val interface{}, patterns StringList) (upstream *Upstream, err error) {
+	upstream = new(Upstream)
+	if server, ok := val.(string); ok {
+		upstream.Server = server
+	} else {
+		content, err := yaml.Marshal(val)
+		if err != nil {
+			return nil, err
+		}
+		if err = yaml.Unmarshal(content, upstream); err != nil {
+			return nil, err
+		}
+	}
+	if patterns != nil {
+		upstream.Patterns = patterns
+	}
+	if !upstream.Validate() {
+		return nil, errors.New("invalid upstream " + upstream.Server)
+	}
+	return upstream, nil
+}
+
+func buildProviders(entries []map[string]interface{}) (providers []RouteProvider) {
+	if len(entries) == 0 {
+		return []RouteProvider{staticProvider{}}
+	}
+	provider_lock.Lock()
+	defer provider_lock.Unlock()
+	providers = make([]RouteProvider, 0, len(entries)+1)
+	has_static := false
+	for idx, options := range entries {
+		kind := ToString(options["type"])
+		if kind == "static" {
+			providers = append(providers, staticProvider{})
+			has_static = true
+			continue
+		}
+		factory, ok := provider_factories[kind]
+		if !ok {
+			log.Errorf("Route provider #%d: unknown type %s, ignored.", idx, kind)
+			continue
+		}
+		provider, err := factory(options)
+		if err != nil {
+			log.Errorf("Route provider #%d (%s): %s, ignored.", idx, kind, err.Error())
+			continue
+		}
+		ttl := time.Duration(ToUint(options["ttl"])) * time.Second
+		negative_ttl := time.Duration(ToUint(options["negative_ttl"])) * time.Second
+		if ttl > 0 || negative_ttl > 0 {
+			provider = newCachedProvider(provider, ttl, negative_ttl)
+		}
+		log.Infof("Route provider #%d: %s", idx, provider.Name())
+		providers = append(providers, provider)
+	}
+	if !has_static {
+		// Otherwise upstreams in config are never used.
+		log.Warn("Route provider static not listed, upstreams in config are consulted after other providers.")
+		providers = append(providers, staticProvider{})
+	}
+	return
+}
+
+func stopProviders(providers []RouteProvider) {
+	for _, provider := range providers {
+		if provider, ok := provider.(providerStopper); ok {
+			provider.stop()
+		}
+	}
+}
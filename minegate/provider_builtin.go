@@ -0,0 +1,218 @@
+package minegate
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/jackyyf/golog"
+	yaml "gopkg.in/yaml.v2"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	RegisterRouteProvider("json", newJSONProvider)
+	RegisterRouteProvider("http", newHTTPProvider)
+	RegisterRouteProvider("srv", newSRVProvider)
+}
+
+// jsonProvider reads a file mapping hostname patterns to upstreams, values
+// are either an address or an object like entries of upstreams:
+//
+//	{"play.example.com": "10.0.0.5:25565",
+//	 "*.mc.example.com": {"upstream": "{1}.internal", "bungeecord": true}}
+//
+// The file is reloaded when modified.
+type jsonProvider struct {
+	file       string
+	lock       sync.Mutex
+	table      *routeTable
+	stop_watch func()
+}
+
+func newJSONProvider(options map[string]interface{}) (RouteProvider, error) {
+	file := ToString(options["file"])
+	if file == "" {
+		return nil, errors.New("no file specified")
+	}
+	provider := new(jsonProvider)
+	provider.file, _ = filepath.Abs(file)
+	if err := provider.reload(); err != nil {
+		return nil, err
+	}
+	provider.stop_watch = WatchFile(provider.file, 5*time.Second, func() {
+		if err := provider.reload(); err != nil {
+			// Keep using routes loaded before.
+			log.Errorf("unable to reload %s: %s", provider.file, err.Error())
+		}
+	})
+	return provider, nil
+}
+
+func (provider *jsonProvider) stop() {
+	provider.stop_watch()
+}
+
+func (provider *jsonProvider) Name() string {
+	return "json " + provider.file
+}
+
+func (provider *jsonProvider) reload() (err error) {
+	content, err := ioutil.ReadFile(provider.file)
+	if err != nil {
+		return err
+	}
+	var raw map[string]interface{}
+	if err = yaml.Unmarshal(content, &raw); err != nil {
+		return err
+	}
+	patterns := make([]string, 0, len(raw))
+	for pattern := range raw {
+		patterns = append(patterns, pattern)
+	}
+	// Map has no order, keep routing deterministic.
+	sort.Strings(patterns)
+	upstreams := make([]*Upstream, 0, len(raw))
+	for _, pattern := range patterns {
+		upstream, err := decodeUpstream(raw[pattern], StringList{pattern})
+		if err != nil {
+			log.Errorf("%s: %s: %s", provider.file, pattern, err.Error())
+			continue
+		}
+		upstreams = append(upstreams, upstream)
+	}
+	table := buildRoutes(upstreams)
+	provider.lock.Lock()
+	provider.table = table
+	provider.lock.Unlock()
+	log.Infof("%d route(s) loaded from %s", len(upstreams), provider.file)
+	return nil
+}
+
+func (provider *jsonProvider) Lookup(req *RouteRequest) (upstream *Upstream, err error) {
+	provider.lock.Lock()
+	table := provider.table
+	provider.lock.Unlock()
+	upstream, _ = table.lookup(req)
+	return upstream, nil
+}
+
+// httpProvider asks an HTTP endpoint for upstream of hostname, which is
+// passed in query string. 200 responses carry an upstream in JSON (the same
+// format as values of json provider), 404 or 204 means not found.
+type httpProvider struct {
+	endpoint string
+	client   *http.Client
+}
+
+const http_provider_max_body = 64 * 1024
+
+func newHTTPProvider(options map[string]interface{}) (RouteProvider, error) {
+	endpoint := ToString(options["url"])
+	if _, err := url.Parse(endpoint); err != nil || endpoint == "" {
+		return nil, fmt.Errorf("invalid url %s", endpoint)
+	}
+	timeout := time.Duration(ToUint(options["timeout"])) * time.Second
+	if timeout == 0 {
+		timeout = 3 * time.Second
+	}
+	return &httpProvider{
+		endpoint: endpoint,
+		client:   &http.Client{Timeout: timeout},
+	}, nil
+}
+
+func (provider *httpProvider) Name() string {
+	return "http " + provider.endpoint
+}
+
+// Results depend on hostname only.
+func (provider *httpProvider) CacheKey(req *RouteRequest) (key string, ok bool) {
+	return NormalizeHost(req.Hostname), true
+}
+
+func (provider *httpProvider) Lookup(req *RouteRequest) (upstream *Upstream, err error) {
+	target, err := url.Parse(provider.endpoint)
+	if err != nil {
+		return nil, err
+	}
+	query := target.Query()
+	query.Set("hostname", NormalizeHost(req.Hostname))
+	target.RawQuery = query.Encode()
+	resp, err := provider.client.Get(target.String())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound, http.StatusNoContent:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	content, err := ioutil.ReadAll(io.LimitReader(resp.Body, http_provider_max_body))
+	if err != nil {
+		return nil, err
+	}
+	var val interface{}
+	if err = yaml.Unmarshal(content, &val); err != nil {
+		return nil, err
+	}
+	return decodeUpstream(val, nil)
+}
+
+// srvProvider looks up SRV record _service._tcp.hostname, only for hostnames
+// ending with suffix if given.
+type srvProvider struct {
+	service string
+	suffix  string
+	errmsg  string
+}
+
+func newSRVProvider(options map[string]interface{}) (RouteProvider, error) {
+	provider := &srvProvider{
+		service: ToString(options["service"]),
+		suffix:  NormalizeHost(ToString(options["suffix"])),
+		errmsg:  ToString(options["onerror"]),
+	}
+	if provider.service == "" {
+		provider.service = "minecraft"
+	}
+	return provider, nil
+}
+
+func (provider *srvProvider) Name() string {
+	return "srv _" + provider.service + "._tcp"
+}
+
+func (provider *srvProvider) CacheKey(req *RouteRequest) (key string, ok bool) {
+	return NormalizeHost(req.Hostname), true
+}
+
+func (provider *srvProvider) Lookup(req *RouteRequest) (upstream *Upstream, err error) {
+	hostname := NormalizeHost(req.Hostname)
+	if provider.suffix != "" && !strings.HasSuffix(hostname, provider.suffix) {
+		return nil, nil
+	}
+	_, addrs, err := net.LookupSRV(provider.service, "tcp", hostname)
+	if err != nil {
+		if dnserr, ok := err.(*net.DNSError); ok && !dnserr.Temporary() {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, nil
+	}
+	target := strings.TrimSuffix(addrs[0].Target, ".")
+	return NewUpstream(net.JoinHostPort(target, strconv.Itoa(int(addrs[0].Port))), provider.errmsg)
+}
@@ -0,0 +1,179 @@
+package minegate
+
+import (
+	"bufio"
+	"github.com/jackyyf/MineGate-Go/mcchat"
+	log "github.com/jackyyf/golog"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// QueueOptions queues players logging in to a full upstream (see
+// max_players). They're kicked with their position in message ({position}
+// and {total} are replaced), and admitted when they reconnect after slots are
+// freed. Positions are kept for timeout seconds after the last attempt.
+// Players in earlier priority tiers (names listed, or in a file with a name
+// per line) are queued before others.
+type QueueOptions struct {
+	Timeout  uint        `yaml:"timeout"`
+	Message  ChatMessage `yaml:"message"`
+	Priority []QueueTier `yaml:"priority"`
+	tiers    []map[string]bool
+}
+
+type QueueTier struct {
+	Names StringList `yaml:"names"`
+	File  string     `yaml:"file"`
+}
+
+type queueEntry struct {
+	name string
+	tier int
+	seq  uint64
+	seen time.Time
+}
+
+// Queues by upstream server, guarded by sessions_lock, so admission and
+// session counting are atomic.
+var queues = make(map[string][]*queueEntry)
+var queue_seq uint64
+
+const full_msg = "Server is full."
+
+func loadNameFile(file string) (names []string, err error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		names = append(names, line)
+	}
+	return names, scanner.Err()
+}
+
+func (queue *QueueOptions) Validate() (valid bool) {
+	if queue.Timeout == 0 {
+		queue.Timeout = 60
+	}
+	if queue.Message.Text == "" {
+		queue.Message.Text = full_msg + " You're #{position} of {total} in queue, please reconnect."
+	}
+	queue.tiers = make([]map[string]bool, 0, len(queue.Priority))
+	for _, tier := range queue.Priority {
+		names := tier.Names
+		if tier.File != "" {
+			loaded, err := loadNameFile(tier.File)
+			if err != nil {
+				log.Errorf("Unable to load queue priority file %s: %s", tier.File, err.Error())
+				return false
+			}
+			names = append(names, loaded...)
+		}
+		set := make(map[string]bool, len(names))
+		for _, name := range names {
+			set[strings.ToLower(name)] = true
+		}
+		queue.tiers = append(queue.tiers, set)
+	}
+	return true
+}
+
+func (queue *QueueOptions) tierOf(name string) int {
+	name = strings.ToLower(name)
+	for idx, tier := range queue.tiers {
+		if tier[name] {
+			return idx
+		}
+	}
+	return len(queue.tiers)
+}
+
+func (queue *QueueOptions) message(position, total int) *mcchat.ChatMsg {
+	msg := queue.Message
+	msg.Text = strings.Replace(msg.Text, "{position}", strconv.Itoa(position), -1)
+	msg.Text = strings.Replace(msg.Text, "{total}", strconv.Itoa(total), -1)
+	return ToChatMsg(&msg)
+}
+
+// admitPlayer starts a session for player to upstream if it's not full (or
+// the player is at front of queue), otherwise returns the kick message.
+func admitPlayer(upstream *Upstream, name string) (kick *mcchat.ChatMsg) {
+	server := upstream.Server
+	sessions_lock.Lock()
+	defer sessions_lock.Unlock()
+	if upstream.MaxPlayers == 0 {
+		startSessionLocked(server)
+		return nil
+	}
+	free := int(upstream.MaxPlayers) - sessions[server]
+	queue := upstream.Queue
+	if queue == nil {
+		if free > 0 {
+			startSessionLocked(server)
+			return nil
+		}
+		return mcchat.NewMsg(full_msg)
+	}
+	now := time.Now()
+	timeout := time.Duration(queue.Timeout) * time.Second
+	entries := queues[server][:0]
+	var entry *queueEntry
+	for _, e := range queues[server] {
+		if now.Sub(e.seen) > timeout {
+			continue
+		}
+		if strings.EqualFold(e.name, name) {
+			entry = e
+		}
+		entries = append(entries, e)
+	}
+	if entry == nil {
+		queue_seq++
+		entry = &queueEntry{name: name, tier: queue.tierOf(name), seq: queue_seq}
+		entries = append(entries, entry)
+		sort.SliceStable(entries, func(i, j int) bool {
+			if entries[i].tier != entries[j].tier {
+				return entries[i].tier < entries[j].tier
+			}
+			return entries[i].seq < entries[j].seq
+		})
+	}
+	entry.seen = now
+	pos := 0
+	for entries[pos] != entry {
+		pos++
+	}
+	if pos < free {
+		entries = append(entries[:pos], entries[pos+1:]...)
+		setQueueLocked(server, entries)
+		startSessionLocked(server)
+		return nil
+	}
+	setQueueLocked(server, entries)
+	return queue.message(pos+1, len(entries))
+}
+
+// Must be called with sessions_lock held.
+func setQueueLocked(server string, entries []*queueEntry) {
+	if len(entries) == 0 {
+		delete(queues, server)
+	} else {
+		queues[server] = entries
+	}
+}
+
+// QueueLength returns number of players waiting for upstream server.
+func QueueLength(server string) int {
+	sessions_lock.Lock()
+	defer sessions_lock.Unlock()
+	return len(queues[server])
+}
@@ -0,0 +1,112 @@
+package minegate
+
+import (
+	log "github.com/jackyyf/golog"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestQueue(t *testing.T) {
+	defer func() {
+		if r := recover(); r != nil {
+			t.Fatalf("Recovered from panic: %s", r)
+			return
+		}
+	}()
+	defer os.Remove("queue.yml")
+	defer os.Remove("queue_vip.txt")
+	log.SetLogLevel(log.FATAL)
+	if err := ioutil.WriteFile("queue_vip.txt", []byte("# VIP\nJeb_\n\n"), 0644); err != nil {
+		t.Fatal("Unable to write to queue_vip.txt")
+		return
+	}
+	if err := ioutil.WriteFile("queue.yml", []byte(
+		`
+listen: ':25565'
+upstreams:
+- hostname: full.example.com
+  upstream: 127.0.0.1:25591
+  max_players: 1
+- hostname: queue.example.com
+  upstream: 127.0.0.1:25592
+  max_players: 2
+  queue:
+    timeout: 30
+    message:
+      text: 'Queue: {position}/{total}'
+    priority:
+    - names: [Notch]
+    - file: queue_vip.txt`), 0644); err != nil {
+		t.Fatal("Unable to write to queue.yml")
+		return
+	}
+	SetConfig("queue.yml")
+	confInit()
+	full, _ := MatchUpstream("full.example.com")
+	queue, _ := MatchUpstream("queue.example.com")
+	if full == nil || queue == nil {
+		t.Fatal("Upstreams not found")
+		return
+	}
+	defer func() {
+		for OnlineCount(full.Server) > 0 {
+			sessionEnd(full.Server)
+		}
+		for OnlineCount(queue.Server) > 0 {
+			sessionEnd(queue.Server)
+		}
+		sessions_lock.Lock()
+		delete(queues, queue.Server)
+		sessions_lock.Unlock()
+	}()
+	if kick := admitPlayer(full, "Steve"); kick != nil {
+		t.Errorf("Steve should be admitted: %s", kick.Text)
+	}
+	if kick := admitPlayer(full, "Alex"); kick == nil || kick.Text != full_msg {
+		t.Error("Alex should be kicked as server is full")
+	}
+	sessionEnd(full.Server)
+	if kick := admitPlayer(full, "Alex"); kick != nil {
+		t.Errorf("Alex should be admitted after Steve left: %s", kick.Text)
+	}
+
+	admitPlayer(queue, "a")
+	admitPlayer(queue, "b")
+	expect := func(name, text string) {
+		kick := admitPlayer(queue, name)
+		if text == "" && kick != nil {
+			t.Errorf("%s should be admitted: %s", name, kick.Text)
+		} else if text != "" && (kick == nil || kick.Text != text) {
+			t.Errorf("%s should be kicked with %s: %+v", name, text, kick)
+		}
+	}
+	expect("Steve", "Queue: 1/1")
+	expect("Alex", "Queue: 2/2")
+	expect("jeb_", "Queue: 1/3")
+	expect("notch", "Queue: 1/4")
+	expect("Steve", "Queue: 3/4")
+	if QueueLength(queue.Server) != 4 {
+		t.Errorf("4 players should be queued, %d found", QueueLength(queue.Server))
+	}
+	// Only the head of queue is admitted when one slot is freed.
+	sessionEnd(queue.Server)
+	expect("Steve", "Queue: 3/4")
+	expect("Notch", "")
+	expect("Jeb_", "Queue: 1/3")
+	// Players not reconnecting in time lose their position.
+	sessions_lock.Lock()
+	for _, entry := range queues[queue.Server] {
+		if entry.name == "jeb_" {
+			entry.seen = time.Now().Add(-time.Minute)
+		}
+	}
+	sessions_lock.Unlock()
+	sessionEnd(queue.Server)
+	expect("Steve", "")
+	expect("Alex", "Queue: 1/1")
+	if !t.Failed() {
+		t.Log("Ok, players queued.")
+	}
+}
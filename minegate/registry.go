@@ -0,0 +1,307 @@
+package minegate
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	log "github.com/jackyyf/golog"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Backends may register themselves through registry API, registered upstreams
+// are routed like those in config, and are kept across config reloads until
+// they're unregistered or miss heartbeats for ttl seconds.
+//
+//   POST   /register          body: {"id": "game-1", "ttl": 30, "hostname": ..., "upstream": ..., ...}
+//   POST   /heartbeat?id=ID
+//   DELETE /register?id=ID
+//   GET    /list
+//
+// Maintenance mode of upstreams (by name, or server if unnamed) can be set
+// with the same API, until it's reset to follow config.
+//
+//   POST   /maintenance?name=NAME&enabled=true
+//   DELETE /maintenance?name=NAME
+//
+// Requests must carry "Authorization: Bearer <token>". listen may be
+// unix:/path/to/socket.
+
+type RegistryOptions struct {
+	Listen string `yaml:"listen"`
+	Token  string `yaml:"token"`
+	TTL    uint   `yaml:"ttl"`
+}
+
+type registryEntry struct {
+	ID       string    `json:"id"`
+	Upstream *Upstream `json:"-"`
+	TTL      uint      `json:"ttl"`
+	Expire   time.Time `json:"expire"`
+}
+
+const registry_max_body = 64 * 1024
+
+var registry_lock sync.Mutex
+var registry = make(map[string]*registryEntry)
+var registry_options RegistryOptions
+var registry_listener net.Listener
+var registry_sweeper sync.Once
+
+// registeredUpstreams returns registered upstreams ordered by id.
+func registeredUpstreams() (upstreams []*Upstream) {
+	registry_lock.Lock()
+	defer registry_lock.Unlock()
+	ids := make([]string, 0, len(registry))
+	for id := range registry {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	upstreams = make([]*Upstream, 0, len(ids))
+	for _, id := range ids {
+		upstreams = append(upstreams, registry[id].Upstream)
+	}
+	return
+}
+
+func registryChanged() {
+	config_lock.Lock()
+	defer config_lock.Unlock()
+	rebuildRoutes()
+}
+
+// Register adds or replaces a registered upstream, which expires after ttl
+// unless Heartbeat is called.
+func Register(id string, upstream *Upstream, ttl time.Duration) (err error) {
+	if id == "" {
+		return errors.New("empty id")
+	}
+	if ttl <= 0 {
+		return errors.New("ttl must be positive")
+	}
+	registry_lock.Lock()
+	registry[id] = &registryEntry{
+		ID:       id,
+		Upstream: upstream,
+		TTL:      uint(ttl / time.Second),
+		Expire:   time.Now().Add(ttl),
+	}
+	registry_lock.Unlock()
+	registry_sweeper.Do(func() {
+		go registrySweeper()
+	})
+	log.Infof("[registry] %s registered: %s => %s", id, strings.Join(upstream.Patterns, ","), upstream.Server)
+	registryChanged()
+	return nil
+}
+
+// Heartbeat renews a registered upstream, returns false if it's unknown (or
+// has expired), in which case it should register again.
+func Heartbeat(id string) (ok bool) {
+	registry_lock.Lock()
+	defer registry_lock.Unlock()
+	entry, ok := registry[id]
+	if !ok {
+		return false
+	}
+	entry.Expire = time.Now().Add(time.Duration(entry.TTL) * time.Second)
+	return true
+}
+
+func Unregister(id string) (ok bool) {
+	registry_lock.Lock()
+	_, ok = registry[id]
+	delete(registry, id)
+	registry_lock.Unlock()
+	if ok {
+		log.Infof("[registry] %s unregistered.", id)
+		registryChanged()
+	}
+	return
+}
+
+func expireRegistry(now time.Time) {
+	changed := false
+	registry_lock.Lock()
+	for id, entry := range registry {
+		if now.After(entry.Expire) {
+			log.Warnf("[registry] %s missed heartbeat, removed.", id)
+			delete(registry, id)
+			changed = true
+		}
+	}
+	registry_lock.Unlock()
+	if changed {
+		registryChanged()
+	}
+}
+
+func registrySweeper() {
+	for {
+		time.Sleep(time.Second)
+		expireRegistry(time.Now())
+	}
+}
+
+func newRegistryID() string {
+	buff := make([]byte, 8)
+	rand.Read(buff)
+	return hex.EncodeToString(buff)
+}
+
+func registryError(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
+
+func registryReply(w http.ResponseWriter, val interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(val)
+}
+
+func registryRegister(w http.ResponseWriter, r *http.Request) {
+	content, err := ioutil.ReadAll(io.LimitReader(r.Body, registry_max_body))
+	if err != nil {
+		registryError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var body map[string]interface{}
+	if err = json.Unmarshal(content, &body); err != nil {
+		registryError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	id := ToString(body["id"])
+	if id == "" {
+		id = newRegistryID()
+	}
+	ttl := ToUint(body["ttl"])
+	if ttl == 0 {
+		registry_lock.Lock()
+		ttl = uint64(registry_options.TTL)
+		registry_lock.Unlock()
+	}
+	delete(body, "id")
+	delete(body, "ttl")
+	upstream, err := decodeUpstream(body, nil)
+	if err != nil {
+		registryError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err = Register(id, upstream, time.Duration(ttl)*time.Second); err != nil {
+		registryError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	registryReply(w, map[string]interface{}{"id": id, "ttl": ttl})
+}
+
+type registryAPI struct{}
+
+func (registryAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	registry_lock.Lock()
+	token := registry_options.Token
+	registry_lock.Unlock()
+	auth := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" || subtle.ConstantTimeCompare([]byte(auth), []byte(token)) != 1 {
+		log.Warnf("[registry] unauthorized request from %s", r.RemoteAddr)
+		registryError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	id := r.URL.Query().Get("id")
+	switch {
+	case r.URL.Path == "/register" && r.Method == "POST":
+		registryRegister(w, r)
+	case r.URL.Path == "/register" && r.Method == "DELETE":
+		if !Unregister(id) {
+			registryError(w, http.StatusNotFound, "no such id")
+			return
+		}
+		registryReply(w, map[string]string{"id": id})
+	case r.URL.Path == "/heartbeat" && r.Method == "POST":
+		if !Heartbeat(id) {
+			registryError(w, http.StatusNotFound, "no such id")
+			return
+		}
+		registryReply(w, map[string]string{"id": id})
+	case r.URL.Path == "/maintenance" && r.Method == "POST":
+		name := r.URL.Query().Get("name")
+		if name == "" {
+			registryError(w, http.StatusBadRequest, "no name specified")
+			return
+		}
+		enabled := ToBool(r.URL.Query().Get("enabled"))
+		SetMaintenance(name, enabled)
+		registryReply(w, map[string]interface{}{"name": name, "enabled": enabled})
+	case r.URL.Path == "/maintenance" && r.Method == "DELETE":
+		name := r.URL.Query().Get("name")
+		ResetMaintenance(name)
+		registryReply(w, map[string]string{"name": name})
+	case r.URL.Path == "/list" && r.Method == "GET":
+		type listEntry struct {
+			*registryEntry
+			Hostname StringList `json:"hostname"`
+			Server   string     `json:"upstream"`
+		}
+		registry_lock.Lock()
+		list := make([]listEntry, 0, len(registry))
+		for _, entry := range registry {
+			e := *entry
+			list = append(list, listEntry{&e, entry.Upstream.Patterns, entry.Upstream.Server})
+		}
+		registry_lock.Unlock()
+		registryReply(w, list)
+	default:
+		registryError(w, http.StatusNotFound, "not found")
+	}
+}
+
+// startRegistry (re)starts registry API when its listen address changes.
+func startRegistry(options RegistryOptions) {
+	if options.TTL == 0 {
+		options.TTL = 30
+	}
+	registry_lock.Lock()
+	defer registry_lock.Unlock()
+	prev := registry_options
+	registry_options = options
+	if options.Listen == prev.Listen && registry_listener != nil {
+		return
+	}
+	if registry_listener != nil {
+		registry_listener.Close()
+		registry_listener = nil
+		log.Infof("[registry] API on %s stopped.", prev.Listen)
+	}
+	if options.Listen == "" {
+		return
+	}
+	if options.Token == "" {
+		log.Error("[registry] No token configured, registry API is not started.")
+		return
+	}
+	var listener net.Listener
+	var err error
+	if strings.HasPrefix(options.Listen, "unix:") {
+		path := strings.TrimPrefix(options.Listen, "unix:")
+		os.Remove(path)
+		listener, err = net.Listen("unix", path)
+	} else {
+		listener, err = net.Listen("tcp", options.Listen)
+	}
+	if err != nil {
+		log.Errorf("[registry] Unable to listen on %s: %s", options.Listen, err.Error())
+		return
+	}
+	registry_listener = listener
+	go http.Serve(listener, registryAPI{})
+	log.Infof("[registry] API listened on %s", options.Listen)
+}
@@ -0,0 +1,86 @@
+package minegate
+
+import (
+	"github.com/jackyyf/MineGate-Go/mcproto"
+	log "github.com/jackyyf/golog"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Forge clients append \0FML\0 (FML2, FML3 for newer versions) to hostname.
+var fml_marker = regexp.MustCompile("^FML[0-9]*$")
+
+// stripFML removes FML markers from data following hostname, which is a list
+// of \0 prefixed fields.
+func stripFML(extra string) string {
+	if extra == "" {
+		return extra
+	}
+	fields := strings.Split(extra[1:], "\x00")
+	res := make([]string, 0, len(fields))
+	for idx := 0; idx < len(fields); idx++ {
+		if !fml_marker.MatchString(fields[idx]) {
+			res = append(res, fields[idx])
+			continue
+		}
+		// Skip the terminating \0 of marker as well.
+		if idx+1 < len(fields) && fields[idx+1] == "" {
+			idx++
+		}
+	}
+	if len(res) == 0 {
+		return ""
+	}
+	return "\x00" + strings.Join(res, "\x00")
+}
+
+func (rewrite *HandshakeRewrite) Validate() (valid bool) {
+	rewrite.Hostname = strings.TrimSpace(rewrite.Hostname)
+	rewrite.Port = strings.ToLower(strings.TrimSpace(rewrite.Port))
+	if rewrite.Port != "" && rewrite.Port != "upstream" {
+		if _, err := strconv.ParseUint(rewrite.Port, 10, 16); err != nil {
+			log.Errorf("Invalid rewrite port %s", rewrite.Port)
+			return false
+		}
+	}
+	rewrite.FML = strings.ToLower(strings.TrimSpace(rewrite.FML))
+	switch rewrite.FML {
+	case "", "keep", "strip":
+	default:
+		log.Errorf("Invalid rewrite fml option %s, should be keep or strip", rewrite.FML)
+		return false
+	}
+	return true
+}
+
+// RewriteHandshake applies rewrite options of upstream to the handshake which
+// will be sent to it.
+func (upstream *Upstream) RewriteHandshake(pkt *mcproto.MCHandShake) {
+	rewrite := &upstream.Rewrite
+	host, extra := pkt.ServerAddr, ""
+	if idx := strings.IndexByte(host, 0); idx != -1 {
+		host, extra = host[:idx], host[idx:]
+	}
+	if rewrite.FML == "strip" {
+		extra = stripFML(extra)
+	}
+	upstream_host, upstream_port, _ := net.SplitHostPort(upstream.Server)
+	switch rewrite.Hostname {
+	case "":
+	case "upstream":
+		host = upstream_host
+	default:
+		host = rewrite.Hostname
+	}
+	pkt.ServerAddr = host + extra
+	port := rewrite.Port
+	if port == "upstream" {
+		port = upstream_port
+	}
+	if port != "" {
+		p, _ := strconv.ParseUint(port, 10, 16)
+		pkt.ServerPort = uint16(p)
+	}
+}
@@ -0,0 +1,181 @@
+package minegate
+
+import (
+	"bufio"
+	"github.com/jackyyf/MineGate-Go/mcproto"
+	log "github.com/jackyyf/golog"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// StartProxy handler is registered once for all tests (and runs of them),
+// events go to the channel of the running test.
+var start_proxy_once sync.Once
+var start_proxy_lock sync.Mutex
+var start_proxy_events chan *StartProxyEvent
+
+func watchStartProxy() (events chan *StartProxyEvent) {
+	start_proxy_once.Do(func() {
+		OnStartProxy(func(spe *StartProxyEvent) {
+			start_proxy_lock.Lock()
+			defer start_proxy_lock.Unlock()
+			select {
+			case start_proxy_events <- spe:
+			default:
+			}
+		}, 39)
+	})
+	events = make(chan *StartProxyEvent, 1)
+	start_proxy_lock.Lock()
+	start_proxy_events = events
+	start_proxy_lock.Unlock()
+	return
+}
+
+func TestHandshakeRewrite(t *testing.T) {
+	defer func() {
+		if r := recover(); r != nil {
+			t.Fatalf("Recovered from panic: %s", r)
+			return
+		}
+	}()
+	defer os.Remove("rewrite.yml")
+	log.SetLogLevel(log.FATAL)
+	if err := ioutil.WriteFile("rewrite.yml", []byte(
+		`
+listen: ':25565'
+upstreams:
+- hostname: '*.mc.example.com'
+  upstream: '{1}.internal:25570'
+  rewrite:
+    hostname: upstream
+    port: upstream
+    fml: strip
+- hostname: lobby.example.com
+  upstream: '127.0.0.1:25565'
+  rewrite:
+    hostname: lobby.internal
+    port: 25575
+- hostname: keep.example.com
+  upstream: '127.0.0.1:25565'
+- hostname: invalid.example.com
+  upstream: '127.0.0.1:25565'
+  rewrite:
+    port: 70000`), 0644); err != nil {
+		t.Fatal("Unable to write to rewrite.yml")
+		return
+	}
+	SetConfig("rewrite.yml")
+	confInit()
+	if len(config.Upstream) != 3 {
+		t.Fatalf("There should be 3 valid upstreams, %d found", len(config.Upstream))
+		return
+	}
+	cases := []struct {
+		addr     string
+		port     uint16
+		expected string
+		eport    uint16
+	}{
+		{"alice.mc.example.com\x00FML\x00", 25565, "alice.internal", 25570},
+		{"bob.mc.example.com\x00FML2\x00\x00127.0.0.1\x00uuid", 25565, "bob.internal\x00127.0.0.1\x00uuid", 25570},
+		{"lobby.example.com\x00FML\x00", 25565, "lobby.internal\x00FML\x00", 25575},
+		{"keep.example.com\x00FML\x00", 25566, "keep.example.com\x00FML\x00", 25566},
+	}
+	for _, c := range cases {
+		upstream, _ := MatchUpstream(c.addr)
+		if upstream == nil {
+			t.Errorf("No upstream found for %q", c.addr)
+			continue
+		}
+		pkt := &mcproto.MCHandShake{Proto: 47, ServerAddr: c.addr, ServerPort: c.port, NextState: 2}
+		upstream.RewriteHandshake(pkt)
+		if pkt.ServerAddr != c.expected || pkt.ServerPort != c.eport {
+			t.Errorf("%q:%d should be rewritten to %q:%d, got %q:%d", c.addr, c.port,
+				c.expected, c.eport, pkt.ServerAddr, pkt.ServerPort)
+		}
+	}
+	if !t.Failed() {
+		t.Log("Ok, handshake rewritten.")
+	}
+}
+
+func TestProxyRewrite(t *testing.T) {
+	defer func() {
+		if r := recover(); r != nil {
+			t.Fatalf("Recovered from panic: %s", r)
+			return
+		}
+	}()
+	log.SetLogLevel(log.FATAL)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err.Error())
+		return
+	}
+	defer listener.Close()
+	received := make(chan *mcproto.MCHandShake, 1)
+	go func() {
+		sock, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer sock.Close()
+		pkt, err := mcproto.ReadPacket(bufio.NewReader(sock))
+		if err != nil {
+			received <- nil
+			return
+		}
+		handshake, _ := pkt.ToHandShake()
+		received <- handshake
+	}()
+	started := watchStartProxy()
+	upstream, err := NewUpstream(listener.Addr().String(), "")
+	if err != nil {
+		t.Fatalf("Unable to create upstream: %s", err.Error())
+		return
+	}
+	upstream.Rewrite.Hostname = "lobby.internal"
+	server, peer := net.Pipe()
+	defer peer.Close()
+	handshake := &mcproto.MCHandShake{Proto: 47, ServerAddr: "lobby.example.com", ServerPort: 25565, NextState: 2}
+	ne := new(PostAcceptEvent)
+	ne.RemoteAddr = &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 50000}
+	go proxy(WrapClientSocket(server), upstream, handshake, ne, nil)
+	login, _ := (&mcproto.MCLogin{Name: "RewriteTest"}).ToRawPacket()
+	peer.Write(login.ToBytes())
+	select {
+	case pkt := <-received:
+		if pkt == nil || pkt.ServerAddr != "lobby.internal" {
+			t.Errorf("Upstream should get rewritten handshake, %+v found", pkt)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("No handshake received by upstream")
+		return
+	}
+	select {
+	case spe := <-started:
+		if spe.InitPacket.ServerAddr != "lobby.example.com" {
+			t.Errorf("Plugins should get handshake of client, %s found", spe.InitPacket.ServerAddr)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("StartProxy not fired")
+		return
+	}
+	// Connection is closed once upstream is gone.
+	peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	io.Copy(ioutil.Discard, peer)
+	peer.Close()
+	// Wait for pipes to end.
+	for idx := 0; idx < 100 && OnlineCount(upstream.Server) != 0; idx++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !t.Failed() {
+		t.Log("Ok, handshake of client kept for plugins.")
+	}
+}
@@ -0,0 +1,336 @@
+package minegate
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/jackyyf/golog"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	routeExact = iota
+	routeWildcard
+	routeRegex
+)
+
+var route_kinds = [...]string{"exact", "wildcard", "regex"}
+
+// RouteRequest carries everything known about a connection when routing.
+type RouteRequest struct {
+	Hostname   string
+	Port       uint16
+	Proto      uint64
+	RemoteAddr *net.TCPAddr
+	// Looked up when needed.
+	geo_done  bool
+	country   string
+	continent string
+}
+
+// NumberRange is an inclusive range, used for ports and protocol versions.
+type NumberRange struct {
+	Min uint64
+	Max uint64
+}
+
+type RangeList []NumberRange
+
+type routeRule struct {
+	Upstream *Upstream
+	pattern  string
+	kind     int
+	regex    *regexp.Regexp
+	// Position in config file, used to break ties.
+	order int
+	// Larger weight means more specific wildcard pattern.
+	weight int
+	// Number of conditions other than hostname, rules with more conditions
+	// are tried first.
+	conditions int
+}
+
+// Routing order: exact hostnames first (hash lookup), then wildcard patterns
+// from the most specific to the least specific, then regex patterns in file
+// order. Among rules for the same pattern, the one with more conditions (port,
+// protocol, source, country, continent) is tried first, then file order.
+type routeTable struct {
+	exact    map[string][]*routeRule
+	wildcard []*routeRule
+	regex    []*routeRule
+}
+
+type byWeight []*routeRule
+
+func (rules byWeight) Len() int {
+	return len(rules)
+}
+
+func (rules byWeight) Swap(i, j int) {
+	rules[i], rules[j] = rules[j], rules[i]
+}
+
+func (rules byWeight) Less(i, j int) bool {
+	if rules[i].weight != rules[j].weight {
+		return rules[i].weight > rules[j].weight
+	}
+	if rules[i].conditions != rules[j].conditions {
+		return rules[i].conditions > rules[j].conditions
+	}
+	return rules[i].order < rules[j].order
+}
+
+// ParseRangeList parses values like 47, 47-340, 763- and -340. max = 0 means
+// no upper limit.
+func ParseRangeList(list StringList, max uint64) (ranges RangeList, err error) {
+	if max == 0 {
+		max = ^uint64(0)
+	}
+	ranges = make(RangeList, 0, len(list))
+	for _, val := range list {
+		val = strings.TrimSpace(val)
+		var r NumberRange
+		parts := strings.SplitN(val, "-", 2)
+		if len(parts) == 1 {
+			if r.Min, err = strconv.ParseUint(val, 10, 64); err != nil {
+				return nil, fmt.Errorf("invalid number %s", val)
+			}
+			r.Max = r.Min
+		} else {
+			r.Max = max
+			if parts[0] != "" {
+				if r.Min, err = strconv.ParseUint(parts[0], 10, 64); err != nil {
+					return nil, fmt.Errorf("invalid range %s", val)
+				}
+			}
+			if parts[1] != "" {
+				if r.Max, err = strconv.ParseUint(parts[1], 10, 64); err != nil {
+					return nil, fmt.Errorf("invalid range %s", val)
+				}
+			}
+		}
+		if r.Min > r.Max || r.Max > max {
+			return nil, errors.New("range out of bound: " + val)
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges, nil
+}
+
+// Empty list contains everything.
+func (ranges RangeList) Contains(val uint64) bool {
+	if len(ranges) == 0 {
+		return true
+	}
+	for _, r := range ranges {
+		if val >= r.Min && val <= r.Max {
+			return true
+		}
+	}
+	return false
+}
+
+func (upstream *Upstream) conditions() (count int) {
+	if len(upstream.ports) > 0 {
+		count++
+	}
+	if len(upstream.protocols) > 0 {
+		count++
+	}
+	if len(upstream.sources) > 0 {
+		count++
+	}
+	if len(upstream.countries) > 0 {
+		count++
+	}
+	if len(upstream.continents) > 0 {
+		count++
+	}
+	return
+}
+
+// accepts checks conditions other than hostname.
+func (upstream *Upstream) accepts(req *RouteRequest) bool {
+	if !upstream.ports.Contains(uint64(req.Port)) || !upstream.protocols.Contains(req.Proto) {
+		return false
+	}
+	if len(upstream.sources) > 0 {
+		if req.RemoteAddr == nil || !InNetworks(req.RemoteAddr.IP, upstream.sources) {
+			return false
+		}
+	}
+	if len(upstream.countries) > 0 || len(upstream.continents) > 0 {
+		country, continent := req.geo()
+		if len(upstream.countries) > 0 && !upstream.countries[country] {
+			return false
+		}
+		if len(upstream.continents) > 0 && !upstream.continents[continent] {
+			return false
+		}
+	}
+	return true
+}
+
+func (rule *routeRule) String() (desc string) {
+	desc = route_kinds[rule.kind] + " rule " + rule.pattern
+	if len(rule.Upstream.Ports) > 0 {
+		desc += " port " + strings.Join(rule.Upstream.Ports, ",")
+	}
+	if len(rule.Upstream.Protocols) > 0 {
+		desc += " protocol " + strings.Join(rule.Upstream.Protocols, ",")
+	}
+	if len(rule.Upstream.Sources) > 0 {
+		desc += " source " + strings.Join(rule.Upstream.Sources, ",")
+	}
+	if len(rule.Upstream.Countries) > 0 {
+		desc += " country " + strings.Join(rule.Upstream.Countries, ",")
+	}
+	if len(rule.Upstream.Continents) > 0 {
+		desc += " continent " + strings.Join(rule.Upstream.Continents, ",")
+	}
+	return
+}
+
+// match returns captures of hostname, the whole hostname is always the first.
+func (rule *routeRule) match(hostname string) (captures []string, ok bool) {
+	switch rule.kind {
+	case routeExact:
+		if rule.pattern == hostname {
+			return []string{hostname}, true
+		}
+	case routeWildcard:
+		// Captures used by upstream may not be empty.
+		if captures, ok = globCapture(rule.pattern, hostname, rule.Upstream.templated); ok {
+			return append([]string{hostname}, captures...), true
+		}
+	case routeRegex:
+		if captures = rule.regex.FindStringSubmatch(hostname); captures != nil {
+			return captures, true
+		}
+	}
+	return nil, false
+}
+
+// Literal characters count 2, single character wildcards count 1, and *
+// counts nothing.
+func patternWeight(pattern string) (weight int) {
+	in_class := false
+	for _, ch := range pattern {
+		switch {
+		case in_class:
+			if ch == ']' {
+				in_class = false
+			}
+		case ch == '[':
+			in_class = true
+			weight += 1
+		case ch == '?':
+			weight += 1
+		case ch == '*':
+		default:
+			weight += 2
+		}
+	}
+	return
+}
+
+func newRouteRule(upstream *Upstream, pattern string, order int) (rule *routeRule) {
+	rule = &routeRule{
+		Upstream:   upstream,
+		pattern:    pattern,
+		order:      order,
+		conditions: upstream.conditions(),
+	}
+	switch {
+	case IsRegexPattern(pattern):
+		rule.kind = routeRegex
+		rule.regex = regexp.MustCompile(pattern[1:])
+	case strings.ContainsAny(pattern, "*?["):
+		rule.kind = routeWildcard
+		rule.weight = patternWeight(pattern)
+	default:
+		rule.kind = routeExact
+	}
+	return
+}
+
+// Upstreams must have been validated.
+func buildRoutes(upstreams []*Upstream) (table *routeTable) {
+	table = &routeTable{
+		exact: make(map[string][]*routeRule),
+	}
+	order := 0
+	for _, upstream := range upstreams {
+		for _, pattern := range upstream.Patterns {
+			rule := newRouteRule(upstream, pattern, order)
+			order++
+			switch rule.kind {
+			case routeExact:
+				table.exact[pattern] = append(table.exact[pattern], rule)
+			case routeWildcard:
+				table.wildcard = append(table.wildcard, rule)
+			case routeRegex:
+				table.regex = append(table.regex, rule)
+			}
+			log.Debugf("route: %s => %s", rule, upstream.Server)
+		}
+	}
+	for _, rules := range table.exact {
+		sort.Stable(byWeight(rules))
+	}
+	sort.Stable(byWeight(table.wildcard))
+	sort.Stable(byWeight(table.regex))
+	return
+}
+
+// rebuildRoutes builds routing table and upstream names from config and
+// registered upstreams, config_lock must be held.
+func rebuildRoutes() {
+	registered := registeredUpstreams()
+	upstreams := make([]*Upstream, 0, len(config.Upstream)+len(registered))
+	upstreams = append(upstreams, config.Upstream...)
+	upstreams = append(upstreams, registered...)
+	config.routes = buildRoutes(upstreams)
+	config.named = make(map[string]*Upstream)
+	for _, upstream := range upstreams {
+		if upstream.Name == "" {
+			continue
+		}
+		if _, ok := config.named[upstream.Name]; ok {
+			log.Warnf("Duplicated upstream name %s, only the first one is used.", upstream.Name)
+			continue
+		}
+		config.named[upstream.Name] = upstream
+	}
+}
+
+func (table *routeTable) match(hostname string, req *RouteRequest) (rule *routeRule, captures []string) {
+	if table == nil {
+		return nil, nil
+	}
+	for _, rule := range table.exact[hostname] {
+		if rule.Upstream.accepts(req) {
+			return rule, []string{hostname}
+		}
+	}
+	for _, rule := range table.wildcard {
+		if !rule.Upstream.accepts(req) {
+			continue
+		}
+		if captures, ok := rule.match(hostname); ok {
+			return rule, captures
+		}
+	}
+	for _, rule := range table.regex {
+		if !rule.Upstream.accepts(req) {
+			continue
+		}
+		if captures, ok := rule.match(hostname); ok {
+			return rule, captures
+		}
+	}
+	return nil, nil
+}
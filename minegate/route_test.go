@@ -0,0 +1,725 @@
+package minegate
+
+import (
+	"github.com/jackyyf/MineGate-Go/internal/mmdbtest"
+	"github.com/jackyyf/MineGate-Go/mcproto"
+	log "github.com/jackyyf/golog"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRouteSpecificFirst(t *testing.T) {
+	defer func() {
+		if r := recover(); r != nil {
+			t.Fatalf("Recovered from panic: %s", r)
+			return
+		}
+	}()
+	defer os.Remove("route_specific.yml")
+	log.SetLogLevel(log.FATAL)
+	if err := ioutil.WriteFile("route_specific.yml", []byte(
+		`
+listen: ':25565'
+upstreams:
+- hostname: '*'
+  upstream: 127.0.0.1:25501
+- hostname: '*.local'
+  upstream: 127.0.0.1:25502
+- hostname: 'play.*.local'
+  upstream: 127.0.0.1:25503
+- hostname: '~^play[0-9]+\.example\.net$'
+  upstream: 127.0.0.1:25504
+- hostname:
+  - hypixel.local
+  - Shop.Example.NET
+  - bücher.example.net
+  upstream: 127.0.0.1:25505
+- hostname: 'lobby*.example.org'
+  upstream: 127.0.0.1:25506`), 0644); err != nil {
+		t.Fatal("Unable to write to route_specific.yml")
+		return
+	}
+	SetConfig("route_specific.yml")
+	confInit()
+	if len(config.Upstream) != 6 {
+		t.Fatalf("There should be 6 valid upstreams, %d found", len(config.Upstream))
+		return
+	}
+	cases := []struct {
+		hostname string
+		server   string
+	}{
+		{"hypixel.local", "127.0.0.1:25505"},
+		{"HYPIXEL.local.", "127.0.0.1:25505"},
+		{"shop.example.net\x00FML\x00", "127.0.0.1:25505"},
+		{"xn--bcher-kva.example.net", "127.0.0.1:25505"},
+		{"Bücher.example.net", "127.0.0.1:25505"},
+		{"play.eu.local", "127.0.0.1:25503"},
+		{"lobby.local", "127.0.0.1:25502"},
+		{"play12.example.net", "127.0.0.1:25501"},
+		{"example.com", "127.0.0.1:25501"},
+		{"lobby.example.org", "127.0.0.1:25506"},
+		{"lobby2.example.org", "127.0.0.1:25506"},
+	}
+	for _, c := range cases {
+		upstream, rule := MatchUpstream(c.hostname)
+		if upstream == nil {
+			t.Errorf("No upstream found for %q", c.hostname)
+			continue
+		}
+		if upstream.Server != c.server {
+			t.Errorf("%q should go to %s, %s found (%s)", c.hostname, c.server, upstream.Server, rule)
+		} else {
+			t.Logf("Ok, %q => %s (%s)", c.hostname, upstream.Server, rule)
+		}
+	}
+}
+
+func TestRouteRegex(t *testing.T) {
+	defer func() {
+		if r := recover(); r != nil {
+			t.Fatalf("Recovered from panic: %s", r)
+			return
+		}
+	}()
+	defer os.Remove("route_regex.yml")
+	log.SetLogLevel(log.FATAL)
+	if err := ioutil.WriteFile("route_regex.yml", []byte(
+		`
+listen: ':25565'
+upstreams:
+- hostname: '~^play[0-9]+\.example\.net$'
+  upstream: 127.0.0.1:25504
+- hostname: '~[invalid'
+  upstream: 127.0.0.1:25505`), 0644); err != nil {
+		t.Fatal("Unable to write to route_regex.yml")
+		return
+	}
+	SetConfig("route_regex.yml")
+	confInit()
+	if len(config.Upstream) != 1 {
+		t.Fatalf("Invalid regex should be rejected, %d upstreams found", len(config.Upstream))
+		return
+	}
+	if upstream, _ := MatchUpstream("play12.example.net"); upstream == nil {
+		t.Error("play12.example.net should match the regex rule")
+	} else {
+		t.Log("Ok, regex matched")
+	}
+	if upstream, _ := MatchUpstream("play.example.net"); upstream != nil {
+		t.Errorf("play.example.net should not match, %s found", upstream.Server)
+	} else {
+		t.Log("Ok, regex not matched")
+	}
+}
+
+func TestRouteTemplate(t *testing.T) {
+	defer func() {
+		if r := recover(); r != nil {
+			t.Fatalf("Recovered from panic: %s", r)
+			return
+		}
+	}()
+	defer os.Remove("route_template.yml")
+	log.SetLogLevel(log.FATAL)
+	if err := ioutil.WriteFile("route_template.yml", []byte(
+		`
+listen: ':25565'
+upstreams:
+- hostname: '*.mc.example.com'
+  upstream: '{1}.internal'
+  onerror:
+    text: 'Server {1} is offline.'
+  forwarding:
+    secret: 'secret-{1}'
+- hostname: '~^([a-z]+)-([0-9]+)\.example\.net$'
+  upstream: '{1}.internal:{2}'
+- hostname: static.example.com
+  upstream: '127.0.0.1:25565'`), 0644); err != nil {
+		t.Fatal("Unable to write to route_template.yml")
+		return
+	}
+	SetConfig("route_template.yml")
+	confInit()
+	if len(config.Upstream) != 3 {
+		t.Fatalf("There should be 3 valid upstreams, %d found", len(config.Upstream))
+		return
+	}
+	upstream, _ := MatchUpstream("Alice.mc.example.com")
+	if upstream == nil {
+		t.Fatal("No upstream found for alice.mc.example.com")
+		return
+	}
+	if upstream.Server != "alice.internal:25565" {
+		t.Errorf("Server should be alice.internal:25565, %s found", upstream.Server)
+	}
+	if upstream.ChatMsg.Text != "Server alice is offline." {
+		t.Errorf("Error message not expanded: %s", upstream.ChatMsg.Text)
+	}
+	secret, err := upstream.GetExtra("forwarding.secret")
+	if err != nil || secret != "secret-alice" {
+		t.Errorf("Extra field not expanded: %v", secret)
+	}
+	if config.Upstream[0].Server != "{1}.internal:25565" {
+		t.Errorf("Template changed after routing: %s", config.Upstream[0].Server)
+	}
+	upstream, _ = MatchUpstream("lobby-25570.example.net")
+	if upstream == nil || upstream.Server != "lobby.internal:25570" {
+		t.Errorf("Regex groups not expanded: %+v", upstream)
+	}
+	if upstream, _ = MatchUpstream(".mc.example.com"); upstream != nil {
+		t.Errorf("Empty capture expanded into %s", upstream.Server)
+	}
+	upstream, _ = MatchUpstream("static.example.com")
+	if upstream != config.Upstream[2] {
+		t.Error("Upstream without placeholder should not be copied")
+	}
+	if !t.Failed() {
+		t.Log("Ok, templates expanded.")
+	}
+}
+
+func TestRouteConditions(t *testing.T) {
+	defer func() {
+		if r := recover(); r != nil {
+			t.Fatalf("Recovered from panic: %s", r)
+			return
+		}
+	}()
+	defer os.Remove("route_conditions.yml")
+	log.SetLogLevel(log.FATAL)
+	if err := ioutil.WriteFile("route_conditions.yml", []byte(
+		`
+listen: ':25565'
+upstreams:
+- hostname: play.local
+  upstream: 127.0.0.1:25501
+- hostname: play.local
+  protocol: 47
+  upstream: 127.0.0.1:25502
+- hostname: play.local
+  protocol: 763-
+  upstream: 127.0.0.1:25503
+- hostname: '*.local'
+  port: [25566, 25570-25580]
+  upstream: 127.0.0.1:25504
+- hostname: '*.local'
+  upstream: 127.0.0.1:25505
+- hostname: broken.local
+  protocol: 340-47
+  upstream: 127.0.0.1:25506`), 0644); err != nil {
+		t.Fatal("Unable to write to route_conditions.yml")
+		return
+	}
+	SetConfig("route_conditions.yml")
+	confInit()
+	if len(config.Upstream) != 5 {
+		t.Fatalf("There should be 5 valid upstreams, %d found", len(config.Upstream))
+		return
+	}
+	cases := []struct {
+		req    RouteRequest
+		server string
+	}{
+		{RouteRequest{Hostname: "play.local", Port: 25565, Proto: 47}, "127.0.0.1:25502"},
+		{RouteRequest{Hostname: "play.local", Port: 25565, Proto: 764}, "127.0.0.1:25503"},
+		{RouteRequest{Hostname: "play.local", Port: 25565, Proto: 340}, "127.0.0.1:25501"},
+		{RouteRequest{Hostname: "lobby.local", Port: 25566}, "127.0.0.1:25504"},
+		{RouteRequest{Hostname: "lobby.local", Port: 25575}, "127.0.0.1:25504"},
+		{RouteRequest{Hostname: "lobby.local", Port: 25565}, "127.0.0.1:25505"},
+	}
+	for _, c := range cases {
+		upstream, rule := MatchRoute(&c.req)
+		if upstream == nil {
+			t.Errorf("No upstream found for %+v", c.req)
+			continue
+		}
+		if upstream.Server != c.server {
+			t.Errorf("%+v should go to %s, %s found (%s)", c.req, c.server, upstream.Server, rule)
+		} else {
+			t.Logf("Ok, %+v => %s (%s)", c.req, upstream.Server, rule)
+		}
+	}
+}
+
+func TestRouteSource(t *testing.T) {
+	defer func() {
+		if r := recover(); r != nil {
+			t.Fatalf("Recovered from panic: %s", r)
+			return
+		}
+	}()
+	defer os.Remove("route_source.yml")
+	log.SetLogLevel(log.FATAL)
+	if err := ioutil.WriteFile("route_source.yml", []byte(
+		`
+listen: ':25565'
+upstreams:
+- hostname: play.local
+  upstream: 10.0.0.1:25565
+- hostname: play.local
+  source: [192.168.0.0/16, 'fd00::/8']
+  upstream: 192.168.1.10:25565
+- hostname: play.local
+  source: 10.8.0.0/24
+  upstream: 10.8.0.1:25565
+- hostname: play.local
+  source: not-an-ip
+  upstream: 10.8.0.2:25565`), 0644); err != nil {
+		t.Fatal("Unable to write to route_source.yml")
+		return
+	}
+	SetConfig("route_source.yml")
+	confInit()
+	if len(config.Upstream) != 3 {
+		t.Fatalf("There should be 3 valid upstreams, %d found", len(config.Upstream))
+		return
+	}
+	cases := []struct {
+		ip     string
+		server string
+	}{
+		{"192.168.3.4", "192.168.1.10:25565"},
+		{"::ffff:192.168.3.4", "192.168.1.10:25565"},
+		{"fd12::1", "192.168.1.10:25565"},
+		{"10.8.0.77", "10.8.0.1:25565"},
+		{"8.8.8.8", "10.0.0.1:25565"},
+	}
+	for _, c := range cases {
+		req := &RouteRequest{
+			Hostname:   "play.local",
+			RemoteAddr: &net.TCPAddr{IP: net.ParseIP(c.ip), Port: 40000},
+		}
+		upstream, rule := MatchRoute(req)
+		if upstream == nil {
+			t.Errorf("No upstream found for %s", c.ip)
+			continue
+		}
+		if upstream.Server != c.server {
+			t.Errorf("%s should go to %s, %s found (%s)", c.ip, c.server, upstream.Server, rule)
+		} else {
+			t.Logf("Ok, %s => %s (%s)", c.ip, upstream.Server, rule)
+		}
+	}
+}
+
+func TestRouteGeo(t *testing.T) {
+	defer func() {
+		if r := recover(); r != nil {
+			t.Fatalf("Recovered from panic: %s", r)
+			return
+		}
+	}()
+	defer os.Remove("route_geo.yml")
+	defer os.Remove("route_geo.mmdb")
+	log.SetLogLevel(log.FATAL)
+	writer := mmdbtest.NewWriter(6)
+	for cidr, codes := range map[string][2]string{
+		"81.0.0.0/8":     {"FR", "EU"},
+		"85.0.0.0/8":     {"DE", "EU"},
+		"2a00::/12":      {"GB", "EU"},
+		"24.0.0.0/8":     {"US", "NA"},
+		"203.0.113.0/24": {"JP", "AS"},
+	} {
+		_, network, _ := net.ParseCIDR(cidr)
+		writer.Insert(network, map[string]interface{}{
+			"country":   map[string]interface{}{"iso_code": codes[0]},
+			"continent": map[string]interface{}{"code": codes[1]},
+		})
+	}
+	db, err := writer.Bytes(24)
+	if err != nil {
+		t.Fatalf("Unable to build geoip database: %s", err.Error())
+		return
+	}
+	if err = ioutil.WriteFile("route_geo.mmdb", db, 0644); err != nil {
+		t.Fatal("Unable to write to route_geo.mmdb")
+		return
+	}
+	if err = ioutil.WriteFile("route_geo.yml", []byte(
+		`
+listen: ':25565'
+geoip: route_geo.mmdb
+upstreams:
+- hostname: play.local
+  upstream: 10.1.0.1:25565
+- hostname: play.local
+  continent: eu
+  upstream: 10.2.0.1:25565
+- hostname: play.local
+  continent: EU
+  country: [de]
+  upstream: 10.2.0.2:25565
+- hostname: play.local
+  continent: [NA, SA]
+  upstream: 10.3.0.1:25565
+- hostname: eu.play.local
+  upstream: 10.2.0.1:25565
+- hostname: play.local
+  continent: XX
+  upstream: 10.4.0.1:25565`), 0644); err != nil {
+		t.Fatal("Unable to write to route_geo.yml")
+		return
+	}
+	SetConfig("route_geo.yml")
+	confInit()
+	defer setGeoIPFile("")
+	if len(config.Upstream) != 5 {
+		t.Fatalf("There should be 5 valid upstreams, %d found", len(config.Upstream))
+		return
+	}
+	if country, continent := LookupCountry(net.ParseIP("85.1.2.3")); country != "DE" || continent != "EU" {
+		t.Errorf("85.1.2.3 should be in DE/EU, %s/%s found", country, continent)
+	}
+	cases := []struct {
+		hostname string
+		ip       string
+		server   string
+	}{
+		{"play.local", "81.2.3.4", "10.2.0.1:25565"},
+		{"play.local", "85.2.3.4", "10.2.0.2:25565"},
+		{"play.local", "2a01::1", "10.2.0.1:25565"},
+		{"play.local", "24.1.1.1", "10.3.0.1:25565"},
+		{"play.local", "203.0.113.5", "10.1.0.1:25565"},
+		{"play.local", "127.0.0.1", "10.1.0.1:25565"},
+		// Explicit region hostname wins over geo routing.
+		{"eu.play.local", "24.1.1.1", "10.2.0.1:25565"},
+	}
+	for _, c := range cases {
+		req := &RouteRequest{
+			Hostname:   c.hostname,
+			RemoteAddr: &net.TCPAddr{IP: net.ParseIP(c.ip), Port: 40000},
+		}
+		upstream, rule := MatchRoute(req)
+		if upstream == nil {
+			t.Errorf("No upstream found for %s from %s", c.hostname, c.ip)
+			continue
+		}
+		if upstream.Server != c.server {
+			t.Errorf("%s from %s should go to %s, %s found (%s)", c.hostname, c.ip, c.server, upstream.Server, rule)
+		} else {
+			t.Logf("Ok, %s from %s => %s (%s)", c.hostname, c.ip, upstream.Server, rule)
+		}
+	}
+}
+
+func TestRoutePlayer(t *testing.T) {
+	defer func() {
+		if r := recover(); r != nil {
+			t.Fatalf("Recovered from panic: %s", r)
+			return
+		}
+	}()
+	defer os.Remove("route_player.yml")
+	defer os.Remove("route_player_map.yml")
+	log.SetLogLevel(log.FATAL)
+	if err := ioutil.WriteFile("route_player_map.yml", []byte(
+		`
+Notch: staff
+`+OfflineUUID("Tester")+`: 127.0.0.1:25580
+069a79f4-44e9-4726-a5be-fca90e38aaf5: staff`), 0644); err != nil {
+		t.Fatal("Unable to write to route_player_map.yml")
+		return
+	}
+	if err := ioutil.WriteFile("route_player.yml", []byte(
+		`
+listen: ':25565'
+player_routes: route_player_map.yml
+upstreams:
+- hostname: play.local
+  upstream: 127.0.0.1:25565
+- name: staff
+  upstream: 127.0.0.1:25570`), 0644); err != nil {
+		t.Fatal("Unable to write to route_player.yml")
+		return
+	}
+	SetConfig("route_player.yml")
+	confInit()
+	defer setPlayerRoutesFile("")
+	upstream, _ := GetUpstream("play.local")
+	if upstream == nil {
+		t.Fatal("No upstream found for play.local")
+		return
+	}
+	uuid := []byte{0x06, 0x9a, 0x79, 0xf4, 0x44, 0xe9, 0x47, 0x26, 0xa5, 0xbe, 0xfc, 0xa9, 0x0e, 0x38, 0xaa, 0xf5}
+	cases := []struct {
+		login  *mcproto.MCLogin
+		server string
+	}{
+		{&mcproto.MCLogin{Name: "notch"}, "127.0.0.1:25570"},
+		{&mcproto.MCLogin{Name: "Tester"}, "127.0.0.1:25580"},
+		{&mcproto.MCLogin{Name: "Someone", Extra: uuid}, "127.0.0.1:25570"},
+		{&mcproto.MCLogin{Name: "Someone"}, "127.0.0.1:25565"},
+	}
+	for _, c := range cases {
+		res, _ := RoutePlayer(upstream, c.login)
+		if res.Server != c.server {
+			t.Errorf("%s should go to %s, %s found", c.login.Name, c.server, res.Server)
+		} else {
+			t.Logf("Ok, %s => %s", c.login.Name, res.Server)
+		}
+	}
+}
+
+func TestRouteProviders(t *testing.T) {
+	defer func() {
+		if r := recover(); r != nil {
+			t.Fatalf("Recovered from panic: %s", r)
+			return
+		}
+	}()
+	defer os.Remove("route_providers.yml")
+	defer os.Remove("route_providers.json")
+	log.SetLogLevel(log.FATAL)
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.URL.Query().Get("hostname") != "panel.example.com" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`{"upstream": "10.0.0.9:25570", "onerror": {"text": "Panel server offline."}}`))
+	}))
+	defer server.Close()
+	if err := ioutil.WriteFile("route_providers.json", []byte(
+		`{"json.example.com": "10.0.0.8",
+ "*.json.example.com": {"upstream": "{1}.internal:25566", "bungeecord": true}}`), 0644); err != nil {
+		t.Fatal("Unable to write to route_providers.json")
+		return
+	}
+	if err := ioutil.WriteFile("route_providers.yml", []byte(
+		`
+listen: ':25565'
+upstreams:
+- hostname: static.example.com
+  upstream: 10.0.0.7:25565
+route_providers:
+- type: static
+- type: json
+  file: route_providers.json
+- type: http
+  url: `+server.URL+`/route
+  ttl: 60
+  negative_ttl: 60
+- type: nonexistent`), 0644); err != nil {
+		t.Fatal("Unable to write to route_providers.yml")
+		return
+	}
+	SetConfig("route_providers.yml")
+	confInit()
+	cases := []struct {
+		hostname string
+		server   string
+	}{
+		{"static.example.com", "10.0.0.7:25565"},
+		{"json.example.com", "10.0.0.8:25565"},
+		{"alice.json.example.com", "alice.internal:25566"},
+		{"panel.example.com", "10.0.0.9:25570"},
+		{"panel.example.com", "10.0.0.9:25570"},
+	}
+	for _, c := range cases {
+		upstream, rule := MatchUpstream(c.hostname)
+		if upstream == nil {
+			t.Errorf("No upstream found for %s", c.hostname)
+			continue
+		}
+		if upstream.Server != c.server {
+			t.Errorf("%s should go to %s, %s found (%s)", c.hostname, c.server, upstream.Server, rule)
+		} else {
+			t.Logf("Ok, %s => %s (%s)", c.hostname, upstream.Server, rule)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if upstream, _ := MatchUpstream("unknown.example.com"); upstream != nil {
+			t.Errorf("unknown.example.com should not be found, %s found", upstream.Server)
+		}
+	}
+	if requests != 2 {
+		t.Errorf("HTTP provider should be asked twice with cache enabled, %d requests found", requests)
+	} else {
+		t.Log("Ok, results are cached.")
+	}
+	if err := ioutil.WriteFile("route_providers.yml", []byte(
+		`
+listen: ':25565'
+upstreams:
+- hostname: static.example.com
+  upstream: 10.0.0.7:25565
+- hostname: json.example.com
+  upstream: 10.0.0.6:25565
+route_providers:
+- type: json
+  file: route_providers.json`), 0644); err != nil {
+		t.Fatal("Unable to write to route_providers.yml")
+		return
+	}
+	confInit()
+	if upstream, _ := MatchUpstream("static.example.com"); upstream == nil || upstream.Server != "10.0.0.7:25565" {
+		t.Errorf("Upstreams in config should be used without static provider, %+v found", upstream)
+	}
+	if upstream, _ := MatchUpstream("json.example.com"); upstream == nil || upstream.Server != "10.0.0.8:25565" {
+		t.Errorf("Listed providers should be consulted before upstreams in config, %+v found", upstream)
+	} else {
+		t.Log("Ok, upstreams in config consulted last without static provider.")
+	}
+}
+
+// sourceProvider routes clients from 10.0.0.0/8 to an internal server, and
+// counts lookups.
+type sourceProvider struct {
+	lookups int
+}
+
+func (provider *sourceProvider) Name() string {
+	return "source"
+}
+
+func (provider *sourceProvider) Lookup(req *RouteRequest) (upstream *Upstream, err error) {
+	provider.lookups++
+	if req.RemoteAddr.IP.To4() != nil && req.RemoteAddr.IP.To4()[0] == 10 {
+		return NewUpstream("10.0.0.10", "")
+	}
+	return NewUpstream("203.0.113.10", "")
+}
+
+type uncachedProvider struct {
+	sourceProvider
+}
+
+func (provider *uncachedProvider) CacheKey(req *RouteRequest) (key string, ok bool) {
+	return "", false
+}
+
+func TestRouteProviderCache(t *testing.T) {
+	defer func() {
+		if r := recover(); r != nil {
+			t.Fatalf("Recovered from panic: %s", r)
+			return
+		}
+	}()
+	log.SetLogLevel(log.FATAL)
+	provider := new(sourceProvider)
+	cache := newCachedProvider(provider, time.Minute, time.Minute)
+	request := func(ip string, port uint16) *RouteRequest {
+		return &RouteRequest{
+			Hostname:   "Play.Example.com.",
+			Port:       port,
+			Proto:      47,
+			RemoteAddr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 50000},
+		}
+	}
+	cases := []struct {
+		ip      string
+		port    uint16
+		server  string
+		lookups int
+	}{
+		{"10.1.2.3", 25565, "10.0.0.10:25565", 1},
+		{"203.0.113.5", 25565, "203.0.113.10:25565", 2},
+		{"10.1.2.3", 25565, "10.0.0.10:25565", 2},
+		{"203.0.113.5", 25565, "203.0.113.10:25565", 2},
+		{"10.1.2.3", 25566, "10.0.0.10:25565", 3},
+	}
+	for idx, c := range cases {
+		upstream, err := cache.Lookup(request(c.ip, c.port))
+		if err != nil || upstream == nil || upstream.Server != c.server {
+			t.Errorf("Case %d: %s should go to %s, %+v found (%v)", idx, c.ip, c.server, upstream, err)
+		}
+		if provider.lookups != c.lookups {
+			t.Errorf("Case %d: %d lookups made, %d expected", idx, provider.lookups, c.lookups)
+		}
+	}
+	uncached := new(uncachedProvider)
+	cache = newCachedProvider(uncached, time.Minute, time.Minute)
+	for i := 0; i < 3; i++ {
+		cache.Lookup(request("10.1.2.3", 25565))
+	}
+	if uncached.lookups != 3 {
+		t.Errorf("Uncacheable results should not be cached, %d lookups made", uncached.lookups)
+	}
+	if !t.Failed() {
+		t.Log("Ok, provider results cached by request.")
+	}
+}
+
+func TestRouteRegistry(t *testing.T) {
+	defer func() {
+		if r := recover(); r != nil {
+			t.Fatalf("Recovered from panic: %s", r)
+			return
+		}
+	}()
+	defer os.Remove("route_registry.yml")
+	log.SetLogLevel(log.FATAL)
+	if err := ioutil.WriteFile("route_registry.yml", []byte(
+		`
+listen: ':25565'
+registry:
+  token: secret
+upstreams:
+- hostname: '*'
+  upstream: 10.0.0.1:25565`), 0644); err != nil {
+		t.Fatal("Unable to write to route_registry.yml")
+		return
+	}
+	SetConfig("route_registry.yml")
+	confInit()
+	api := httptest.NewServer(registryAPI{})
+	defer api.Close()
+	post := func(path, token, body string) int {
+		req, _ := http.NewRequest("POST", api.URL+path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %s", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	body := `{"id": "game-1", "ttl": 30, "name": "game1", "hostname": "game1.mini.local",
+		"upstream": "10.0.0.5:25570", "bungeecord": true}`
+	if code := post("/register", "wrong", body); code != http.StatusUnauthorized {
+		t.Errorf("Request with wrong token should be rejected, %d found", code)
+	}
+	if code := post("/register", "secret", body); code != http.StatusOK {
+		t.Fatalf("Register failed: %d", code)
+		return
+	}
+	upstream, rule := MatchUpstream("game1.mini.local")
+	if upstream == nil || upstream.Server != "10.0.0.5:25570" {
+		t.Fatalf("Registered upstream should win over *, %+v found (%s)", upstream, rule)
+		return
+	}
+	if bungee, err := upstream.GetExtra("bungeecord"); err != nil || bungee != true {
+		t.Errorf("Extra field of registered upstream not kept: %v", bungee)
+	}
+	if _, ok := upstream.Extras["ttl"]; ok {
+		t.Error("ttl should not be kept as extra field")
+	}
+	if FindUpstream("game1") == nil {
+		t.Error("Registered upstream should be found by name")
+	}
+	if code := post("/heartbeat?id=game-1", "secret", ""); code != http.StatusOK {
+		t.Errorf("Heartbeat failed: %d", code)
+	}
+	if code := post("/heartbeat?id=game-2", "secret", ""); code != http.StatusNotFound {
+		t.Errorf("Heartbeat of unknown id should fail, %d found", code)
+	}
+	ConfReload()
+	if upstream, _ := MatchUpstream("game1.mini.local"); upstream == nil || upstream.Server != "10.0.0.5:25570" {
+		t.Error("Registered upstream should survive config reload")
+	}
+	expireRegistry(time.Now().Add(time.Minute))
+	if upstream, _ := MatchUpstream("game1.mini.local"); upstream == nil || upstream.Server != "10.0.0.1:25565" {
+		t.Error("Registered upstream should expire after ttl")
+	}
+	if !t.Failed() {
+		t.Log("Ok, registry works.")
+	}
+}
@@ -0,0 +1,125 @@
+package minegate
+
+import (
+	"github.com/jackyyf/MineGate-Go/mcchat"
+	log "github.com/jackyyf/golog"
+	"time"
+)
+
+// Schedule changes upstream settings while when (a cron expression, see
+// ParseCron) matches current time in timezone (local time by default). All
+// matching schedules are applied in order, later ones win.
+//
+//   schedules:
+//   - when: '* 0-14,21-23 * * *'
+//     login: false
+//     message:
+//       text: 'Open from 15:00 to 21:00.'
+//   - when: '* * * * sat,sun'
+//     motd:
+//       text: 'Weekend event!'
+//     upstream: event
+type Schedule struct {
+	When        string       `yaml:"when"`
+	Timezone    string       `yaml:"timezone"`
+	Maintenance *bool        `yaml:"maintenance"`
+	Login       *bool        `yaml:"login"`
+	Message     ChatMessage  `yaml:"message"`
+	MOTD        *ChatMessage `yaml:"motd"`
+	// Name or address of upstream to route to.
+	Upstream string `yaml:"upstream"`
+	cron     *CronExpr
+	location *time.Location
+	message  *mcchat.ChatMsg
+	motd     *mcchat.ChatMsg
+}
+
+// Clock tells current time to schedules, replaced in tests.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+var schedule_clock Clock = systemClock{}
+
+func (schedule *Schedule) Validate() (valid bool) {
+	var err error
+	if schedule.cron, err = ParseCron(schedule.When); err != nil {
+		log.Errorf("Invalid schedule %s: %s", schedule.When, err.Error())
+		return false
+	}
+	schedule.location = time.Local
+	if schedule.Timezone != "" {
+		if schedule.location, err = time.LoadLocation(schedule.Timezone); err != nil {
+			log.Errorf("Invalid timezone %s: %s", schedule.Timezone, err.Error())
+			return false
+		}
+	}
+	if schedule.Message.Text == "" {
+		schedule.Message.Text = "Server is closed now."
+	}
+	schedule.message = ToChatMsg(&schedule.Message)
+	if schedule.MOTD != nil {
+		schedule.motd = ToChatMsg(schedule.MOTD)
+	}
+	return true
+}
+
+func (schedule *Schedule) Active(now time.Time) bool {
+	return schedule.cron.Match(now.In(schedule.location))
+}
+
+// scheduled returns a copy of upstream with active schedules applied, or
+// upstream itself if none is active.
+func (upstream *Upstream) scheduled() (res *Upstream) {
+	if upstream.scheduleApplied || len(upstream.Schedules) == 0 {
+		return upstream
+	}
+	now := schedule_clock.Now()
+	var active []*Schedule
+	target := ""
+	for _, schedule := range upstream.Schedules {
+		if schedule.Active(now) {
+			active = append(active, schedule)
+			if schedule.Upstream != "" {
+				target = schedule.Upstream
+			}
+		}
+	}
+	if len(active) == 0 {
+		return upstream
+	}
+	res = new(Upstream)
+	*res = *upstream
+	if target != "" {
+		// Only the server changes, other settings are still those of upstream.
+		if named := FindUpstream(target); named != nil {
+			res.Server = named.Server
+		} else if server, err := normalizeServer(target); err == nil {
+			res.Server = server
+		} else {
+			log.Errorf("Invalid scheduled upstream %s: %s", target, err.Error())
+		}
+	}
+	for _, schedule := range active {
+		if schedule.Maintenance != nil {
+			res.Maintenance.Enabled = *schedule.Maintenance
+		}
+		if schedule.Login != nil {
+			res.loginClosed = nil
+			if !*schedule.Login {
+				res.loginClosed = schedule.message
+			}
+		}
+		if schedule.motd != nil {
+			res.motd = schedule.motd
+		}
+	}
+	res.scheduleApplied = true
+	return res
+}
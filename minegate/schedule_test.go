@@ -0,0 +1,264 @@
+package minegate
+
+import (
+	"github.com/jackyyf/MineGate-Go/mcproto"
+	log "github.com/jackyyf/golog"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (clock *fakeClock) Now() time.Time {
+	return clock.now
+}
+
+func TestCron(t *testing.T) {
+	defer func() {
+		if r := recover(); r != nil {
+			t.Fatalf("Recovered from panic: %s", r)
+			return
+		}
+	}()
+	// 2024-01-05 is a friday.
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2024, time.January, day, hour, minute, 0, 0, time.UTC)
+	}
+	cases := []struct {
+		expr     string
+		time     time.Time
+		expected bool
+	}{
+		{"* * * * *", at(5, 3, 7), true},
+		{"* 15-20 * * 1-5", at(5, 15, 0), true},
+		{"* 15-20 * * mon-fri", at(5, 20, 59), true},
+		{"* 15-20 * * 1-5", at(5, 21, 0), false},
+		{"* 15-20 * * 1-5", at(6, 16, 0), false},
+		{"* * * * sat,sun", at(6, 16, 0), true},
+		{"* * * * 7", at(7, 16, 0), true},
+		{"*/15 * * * *", at(5, 1, 30), true},
+		{"*/15 * * * *", at(5, 1, 31), false},
+		{"30/10 * * * *", at(5, 1, 50), true},
+		{"0 12 1 jan *", at(1, 12, 0), true},
+		{"0 12 1 feb *", at(1, 12, 0), false},
+		// Either day of month or day of week.
+		{"* * 1 * fri", at(5, 0, 0), true},
+		{"* * 1 * fri", at(6, 0, 0), false},
+		{"* * */2 * *", at(5, 0, 0), true},
+		{"* * */2 * *", at(6, 0, 0), false},
+		// Full ranges are the same as *.
+		{"* * */1 * fri", at(6, 0, 0), false},
+		{"* * 1-31 * fri", at(6, 0, 0), false},
+		{"* * 1 * */1", at(6, 0, 0), false},
+		{"* * 1 * 0-6", at(6, 0, 0), false},
+		{"* * 1 * 1-7", at(1, 0, 0), true},
+		{"* * 1 * 1-7", at(6, 0, 0), false},
+		{"* * 1 * 1-6", at(7, 0, 0), false},
+	}
+	for _, c := range cases {
+		cron, err := ParseCron(c.expr)
+		if err != nil {
+			t.Errorf("Unable to parse %s: %s", c.expr, err.Error())
+			continue
+		}
+		if cron.Match(c.time) != c.expected {
+			t.Errorf("%s should match %s: %t", c.expr, c.time, c.expected)
+		}
+	}
+	for _, expr := range []string{"* * * *", "60 * * * *", "* 5-3 * * *", "*/0 * * * *", "* * 0 * *", "* * * foo *"} {
+		if _, err := ParseCron(expr); err == nil {
+			t.Errorf("%s should be invalid", expr)
+		}
+	}
+	if !t.Failed() {
+		t.Log("Ok, cron expressions matched.")
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	defer func() {
+		if r := recover(); r != nil {
+			t.Fatalf("Recovered from panic: %s", r)
+			return
+		}
+	}()
+	defer os.Remove("schedule.yml")
+	clock := new(fakeClock)
+	schedule_clock = clock
+	defer func() {
+		schedule_clock = systemClock{}
+	}()
+	log.SetLogLevel(log.FATAL)
+	if err := ioutil.WriteFile("schedule.yml", []byte(
+		`
+listen: ':25565'
+upstreams:
+- name: event
+  hostname: event.example.com
+  upstream: 10.0.0.9:25565
+- hostname: school.example.com
+  upstream: 10.0.0.2:25565
+  schedules:
+  - when: '* 0-14,21-23 * * *'
+    timezone: UTC
+    login: false
+    message:
+      text: 'Open from 15:00 to 21:00.'
+  - when: '* * * * sat,sun'
+    timezone: UTC
+    login: false
+    motd:
+      text: 'Closed on weekends.'
+  - when: '0-29 18 * * fri'
+    timezone: UTC
+    maintenance: true
+- hostname: weekend.example.com
+  upstream: 10.0.0.3:25565
+  schedules:
+  - when: '* * * * sat,sun'
+    timezone: UTC
+    upstream: event
+    motd:
+      text: 'Weekend event!'
+- hostname: invalid.example.com
+  upstream: 10.0.0.4:25565
+  schedules:
+  - when: '* 25 * * *'`), 0644); err != nil {
+		t.Fatal("Unable to write to schedule.yml")
+		return
+	}
+	SetConfig("schedule.yml")
+	confInit()
+	if len(config.Upstream) != 3 {
+		t.Fatalf("There should be 3 valid upstreams, %d found", len(config.Upstream))
+		return
+	}
+	school, _ := MatchUpstream("school.example.com")
+	weekend, _ := MatchUpstream("weekend.example.com")
+	// Friday 16:00 UTC, told in UTC+8.
+	clock.now = time.Date(2024, time.January, 6, 0, 0, 0, 0, time.FixedZone("UTC+8", 8*3600))
+	if res := school.scheduled(); res != school {
+		t.Error("No schedule should be active on friday 16:00")
+	}
+	// Friday 10:00 UTC.
+	clock.now = time.Date(2024, time.January, 5, 10, 0, 0, 0, time.UTC)
+	res := school.scheduled()
+	if res.loginClosed == nil || res.loginClosed.Text != "Open from 15:00 to 21:00." {
+		t.Errorf("Login should be closed on friday 10:00: %+v", res.loginClosed)
+	}
+	if school.loginClosed != nil || res.scheduled() != res {
+		t.Error("Schedules should be applied to a copy, only once")
+	}
+	// Friday 18:15 UTC.
+	clock.now = time.Date(2024, time.January, 5, 18, 15, 0, 0, time.UTC)
+	if res = school.scheduled(); !res.InMaintenance() || res.loginClosed != nil {
+		t.Error("School should be in maintenance on friday 18:15")
+	}
+	// Saturday 16:00 UTC.
+	clock.now = time.Date(2024, time.January, 6, 16, 0, 0, 0, time.UTC)
+	res = school.scheduled()
+	if res.loginClosed == nil || res.motd == nil || res.motd.Text != "Closed on weekends." {
+		t.Errorf("Login should be closed on weekends: %+v", res)
+	}
+	res = weekend.scheduled()
+	if res.Server != "10.0.0.9:25565" {
+		t.Errorf("Weekend should be routed to event, %s found", res.Server)
+	}
+	if res.Name != "" || res.Pattern != "weekend.example.com" || res.ChatMsg != weekend.ChatMsg {
+		t.Errorf("Only server should be taken from event: %+v", res)
+	}
+	handshake := &mcproto.MCHandShake{Proto: 47, ServerAddr: "weekend.example.com", ServerPort: 25565, NextState: 1}
+	res.Status = &StaticStatus{}
+	res.Status.Validate()
+	if resp, err := FetchStatus(0, res, handshake); err != nil || resp.Description.Text != "Weekend event!" {
+		t.Errorf("MOTD should be replaced on weekends: %+v", resp)
+	}
+	if !t.Failed() {
+		t.Log("Ok, schedules applied.")
+	}
+}
+
+func TestProxyScheduled(t *testing.T) {
+	defer func() {
+		if r := recover(); r != nil {
+			t.Fatalf("Recovered from panic: %s", r)
+			return
+		}
+	}()
+	defer os.Remove("schedule_proxy.yml")
+	log.SetLogLevel(log.FATAL)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err.Error())
+		return
+	}
+	defer listener.Close()
+	dialed := make(chan bool, 1)
+	go func() {
+		sock, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		dialed <- true
+		io.Copy(ioutil.Discard, sock)
+		sock.Close()
+	}()
+	if err := ioutil.WriteFile("schedule_proxy.yml", []byte(
+		`
+listen: ':25565'
+upstreams:
+- hostname: lobby.example.com
+  upstream: 127.0.0.1:1
+  schedules:
+  - when: '* * * * *'
+    upstream: '`+listener.Addr().String()+`'`), 0644); err != nil {
+		t.Fatal("Unable to write to schedule_proxy.yml")
+		return
+	}
+	SetConfig("schedule_proxy.yml")
+	confInit()
+	upstream, _ := MatchUpstream("lobby.example.com")
+	if upstream == nil {
+		t.Fatal("No upstream found for lobby.example.com")
+		return
+	}
+	started := watchStartProxy()
+	server, peer := net.Pipe()
+	defer peer.Close()
+	handshake := &mcproto.MCHandShake{Proto: 47, ServerAddr: "lobby.example.com", ServerPort: 25565, NextState: 2}
+	ne := new(PostAcceptEvent)
+	ne.RemoteAddr = &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 50000}
+	go proxy(WrapClientSocket(server), upstream, handshake, ne, nil)
+	login, _ := (&mcproto.MCLogin{Name: "ScheduleTest"}).ToRawPacket()
+	peer.Write(login.ToBytes())
+	select {
+	case <-dialed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Scheduled server not dialed")
+		return
+	}
+	select {
+	case spe := <-started:
+		if spe.Upstream != upstream {
+			t.Errorf("Plugins should get routed upstream, %+v found", spe.Upstream)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("StartProxy not fired")
+		return
+	}
+	peer.Close()
+	listener.Close()
+	// Wait for pipes to end.
+	for idx := 0; idx < 100 && OnlineCount(listener.Addr().String()) != 0; idx++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !t.Failed() {
+		t.Log("Ok, scheduled server dialed, routed upstream kept for plugins.")
+	}
+}
@@ -0,0 +1,45 @@
+package minegate
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Players being proxied, by upstream server.
+var sessions_lock sync.Mutex
+var sessions = make(map[string]int)
+
+func sessionStart(server string) {
+	sessions_lock.Lock()
+	startSessionLocked(server)
+	sessions_lock.Unlock()
+}
+
+// Must be called with sessions_lock held.
+func startSessionLocked(server string) {
+	atomic.AddUint32(&total_online, 1)
+	sessions[server]++
+}
+
+func sessionEnd(server string) {
+	atomic.AddUint32(&total_online, ^uint32(0))
+	sessions_lock.Lock()
+	if sessions[server] <= 1 {
+		delete(sessions, server)
+	} else {
+		sessions[server]--
+	}
+	sessions_lock.Unlock()
+}
+
+// OnlineCount returns number of players proxied to upstream server.
+func OnlineCount(server string) int {
+	sessions_lock.Lock()
+	defer sessions_lock.Unlock()
+	return sessions[server]
+}
+
+// TotalOnline returns number of players proxied by MineGate.
+func TotalOnline() int {
+	return int(atomic.LoadUint32(&total_online))
+}
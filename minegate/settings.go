@@ -0,0 +1,54 @@
+package minegate
+
+import (
+	"sync"
+)
+
+// Settings are dropped when there are too many.
+const max_upstream_settings = 4096
+
+// UpstreamSettings holds settings parsed by a plugin from upstreams, by
+// upstream. Upstreams sharing a server have their own settings. Configured
+// upstreams are parsed on Load, others (like templated ones, or those from
+// providers) on first use.
+type UpstreamSettings struct {
+	parse  func(upstream *Upstream) interface{}
+	lock   sync.Mutex
+	values map[*Upstream]interface{}
+}
+
+func NewUpstreamSettings(parse func(upstream *Upstream) interface{}) *UpstreamSettings {
+	return &UpstreamSettings{parse: parse, values: make(map[*Upstream]interface{})}
+}
+
+// Load parses settings of all upstreams, dropping those parsed before, and
+// returns them.
+func (settings *UpstreamSettings) Load() (values []interface{}) {
+	parsed := make(map[*Upstream]interface{})
+	for _, upstream := range Upstreams() {
+		parsed[upstream] = settings.parse(upstream)
+		values = append(values, parsed[upstream])
+	}
+	settings.lock.Lock()
+	settings.values = parsed
+	settings.lock.Unlock()
+	return
+}
+
+// Get returns settings of upstream.
+func (settings *UpstreamSettings) Get(upstream *Upstream) interface{} {
+	settings.lock.Lock()
+	value, ok := settings.values[upstream]
+	settings.lock.Unlock()
+	if ok {
+		return value
+	}
+	value = settings.parse(upstream)
+	settings.lock.Lock()
+	if len(settings.values) >= max_upstream_settings {
+		settings.values = make(map[*Upstream]interface{})
+	}
+	settings.values[upstream] = value
+	settings.lock.Unlock()
+	return value
+}
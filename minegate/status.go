@@ -0,0 +1,409 @@
+package minegate
+
+import (
+	"github.com/jackyyf/MineGate-Go/mcproto"
+	log "github.com/jackyyf/golog"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Status of upstream is requested once for concurrent pings of the same
+// hostname and protocol, and kept for status_cache seconds if set. Responses
+// are cached encoded by protocol of client, every client gets its own copy to
+// customize in PreStatusResponse. At most status_protocols protocols are
+// cached for a hostname, the one expiring first makes room for a new one, and
+// at most status_protocols requests are in flight, others wait for them.
+
+type statusKey struct {
+	server string
+	host   string
+}
+
+type statusCall struct {
+	done    chan struct{}
+	payload []byte
+	err     error
+	expire  time.Time
+}
+
+type statusEntry struct {
+	// By protocol, in flight or cached.
+	calls map[uint64]*statusCall
+}
+
+const status_timeout = 10 * time.Second
+const status_cache_sweep = 4096
+const status_protocols = 8
+
+var status_lock sync.Mutex
+var status_cache = make(map[statusKey]*statusEntry)
+
+func (call *statusCall) finished() bool {
+	select {
+	case <-call.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Must be called with status_lock held.
+func (call *statusCall) valid(now time.Time) bool {
+	return !call.finished() || now.Before(call.expire)
+}
+
+// requestStatus asks upstream for its status, returns payload of the response.
+func requestStatus(connID uint64, upstream *Upstream, handshake *mcproto.MCHandShake) (payload []byte, err error) {
+	init_raw, err := handshake.ToRawPacket()
+	if err != nil {
+		return nil, err
+	}
+	upconn, err := dialUpstream(connID, upstream)
+	if err != nil {
+		return nil, err
+	}
+	defer upconn.Close()
+	upconn.SetTimeout(status_timeout)
+	req := &mcproto.RAWPacket{ID: 0, Payload: []byte{}}
+	if _, err = upconn.Write(init_raw.ToBytes()); err != nil {
+		return nil, err
+	}
+	if _, err = upconn.Write(req.ToBytes()); err != nil {
+		return nil, err
+	}
+	resp_pkt, err := mcproto.ReadPacket(upconn)
+	if err != nil {
+		return nil, err
+	}
+	payload = resp_pkt.Payload
+	resp, err := resp_pkt.ToStatusResponse()
+	if err != nil {
+		return nil, err
+	}
+	if resp.Favicon != "" {
+		if err = resp.Favicon.Validate(); err != nil {
+			upconn.Warnf("invalid favicon dropped: %s", err.Error())
+			resp.Favicon = ""
+			if resp_pkt, err = resp.ToRawPacket(); err != nil {
+				return nil, err
+			}
+			payload = resp_pkt.Payload
+		}
+	}
+	return payload, nil
+}
+
+// FetchStatus returns status response of upstream for handshake sent by
+// client, which is rewritten for upstream. Every call gets its own copy of
+// response.
+func FetchStatus(connID uint64, upstream *Upstream, handshake *mcproto.MCHandShake) (resp *mcproto.MCStatusResponse, err error) {
+	pkt := *handshake
+	upstream.RewriteHandshake(&pkt)
+	if upstream.Status != nil {
+		log.Debugf("[#%d] static status of %s", connID, upstream.Server)
+		resp, err = upstream.Status.Response(&pkt)
+	} else {
+		resp, err = fetchStatus(connID, upstream, &pkt)
+	}
+	if err != nil {
+		return nil, err
+	}
+	upstream.Players.apply(upstream, resp)
+	upstream.Version.apply(resp, handshake.Proto)
+	if upstream.motd != nil {
+		motd := *upstream.motd
+		resp.Description = &motd
+	}
+	return resp, nil
+}
+
+// fetchStatus returns status response of upstream for handshake, from cache
+// or an in flight request if possible.
+func fetchStatus(connID uint64, upstream *Upstream, handshake *mcproto.MCHandShake) (resp *mcproto.MCStatusResponse, err error) {
+	key := statusKey{upstream.Server, NormalizeHost(handshake.ServerAddr)}
+	ttl := time.Duration(upstream.StatusCache) * time.Second
+	status_lock.Lock()
+	call, wait := sharedStatus(key, handshake.Proto, time.Now())
+	for wait != nil {
+		status_lock.Unlock()
+		<-wait.done
+		status_lock.Lock()
+		call, wait = sharedStatus(key, handshake.Proto, time.Now())
+	}
+	if call != nil {
+		status_lock.Unlock()
+		log.Debugf("[#%d] status of %s is shared.", connID, upstream.Server)
+		<-call.done
+	} else {
+		entry := status_cache[key]
+		call = &statusCall{done: make(chan struct{})}
+		entry.calls[handshake.Proto] = call
+		status_lock.Unlock()
+		call.payload, call.err = requestStatus(connID, upstream, handshake)
+		status_lock.Lock()
+		call.expire = time.Now().Add(ttl)
+		if (call.err != nil || ttl <= 0) && entry.calls[handshake.Proto] == call {
+			delete(entry.calls, handshake.Proto)
+		}
+		close(call.done)
+		status_lock.Unlock()
+	}
+	if call.err != nil {
+		return nil, call.err
+	}
+	pkt := &mcproto.RAWPacket{ID: 0, Payload: call.payload}
+	return pkt.ToStatusResponse()
+}
+
+// sharedStatus returns the request to share for proto, or nil if upstream
+// should be asked, with room made for it. If too many requests are in flight,
+// one of them is returned as wait, to try again once it's done. Must be
+// called with status_lock held.
+func sharedStatus(key statusKey, proto uint64, now time.Time) (call *statusCall, wait *statusCall) {
+	entry := status_cache[key]
+	if entry == nil {
+		if len(status_cache) >= status_cache_sweep {
+			sweepStatus(now)
+		}
+		entry = &statusEntry{calls: make(map[uint64]*statusCall)}
+		status_cache[key] = entry
+	}
+	if call = entry.calls[proto]; call != nil && call.valid(now) {
+		return call, nil
+	}
+	var oldest *statusCall
+	var oldest_proto uint64
+	flight := 0
+	for cached, call := range entry.calls {
+		switch {
+		case !call.finished():
+			flight++
+			wait = call
+		case !call.valid(now):
+			delete(entry.calls, cached)
+		case oldest == nil || call.expire.Before(oldest.expire):
+			oldest, oldest_proto = call, cached
+		}
+	}
+	if flight >= status_protocols {
+		return nil, wait
+	}
+	if len(entry.calls) >= status_protocols {
+		delete(entry.calls, oldest_proto)
+	}
+	return nil, nil
+}
+
+// Must be called with status_lock held.
+func sweepStatus(now time.Time) {
+	for key, entry := range status_cache {
+		for proto, call := range entry.calls {
+			if !call.valid(now) {
+				delete(entry.calls, proto)
+			}
+		}
+		if len(entry.calls) == 0 {
+			delete(status_cache, key)
+		}
+	}
+	if len(status_cache) >= status_cache_sweep {
+		// Requests in flight are finished by their callers anyway.
+		status_cache = make(map[statusKey]*statusEntry)
+	}
+}
+
+// StaticStatus is answered to pings locally, without dialing upstream.
+// Protocol 0 means the protocol version of client, so it's never shown as
+// incompatible.
+type StaticStatus struct {
+	Version     string      `yaml:"version"`
+	Protocol    int         `yaml:"protocol"`
+	MaxPlayers  int         `yaml:"max_players"`
+	Online      int         `yaml:"online"`
+	Sample      StringList  `yaml:"sample"`
+	Description ChatMessage `yaml:"description"`
+	Favicon     string      `yaml:"favicon"`
+	payload     []byte
+}
+
+const status_sample_id = "00000000-0000-0000-0000-000000000000"
+
+func (status *StaticStatus) Validate() (valid bool) {
+	resp := new(mcproto.MCStatusResponse)
+	resp.Version.Name = status.Version
+	if resp.Version.Name == "" {
+		resp.Version.Name = "minegate"
+	}
+	resp.Version.Protocol = status.Protocol
+	resp.Players.Max = status.MaxPlayers
+	resp.Players.Online = status.Online
+	for _, line := range status.Sample {
+		resp.Players.Sample = append(resp.Players.Sample, mcproto.StatusPlayer{Name: line, ID: status_sample_id})
+	}
+	resp.Description = ToChatMsg(&status.Description)
+	if status.Favicon != "" {
+		icon, err := mcproto.LoadIcon(status.Favicon)
+		if err != nil {
+			log.Errorf("Unable to load favicon %s: %s", status.Favicon, err.Error())
+		} else {
+			resp.Favicon = icon
+		}
+	}
+	pkt, err := resp.ToRawPacket()
+	if err != nil {
+		log.Errorf("Invalid static status: %s", err.Error())
+		return false
+	}
+	status.payload = pkt.Payload
+	return true
+}
+
+// Response returns a new copy of the static status for handshake.
+func (status *StaticStatus) Response(handshake *mcproto.MCHandShake) (resp *mcproto.MCStatusResponse, err error) {
+	pkt := &mcproto.RAWPacket{ID: 0, Payload: status.payload}
+	if resp, err = pkt.ToStatusResponse(); err != nil {
+		return nil, err
+	}
+	if resp.Version.Protocol == 0 {
+		resp.Version.Protocol = int(handshake.Proto)
+	}
+	return resp, nil
+}
+
+// iconSet rotates between icons loaded from files.
+type iconSet struct {
+	icons []mcproto.Icon
+	next  *uint32
+}
+
+func loadIcons(files StringList) (set iconSet) {
+	set.next = new(uint32)
+	for _, file := range files {
+		icon, err := mcproto.LoadIcon(file)
+		if err != nil {
+			log.Errorf("Unable to load favicon %s: %s", file, err.Error())
+			continue
+		}
+		set.icons = append(set.icons, icon)
+	}
+	return
+}
+
+// pick returns the next icon, or empty string if there's none.
+func (set iconSet) pick() mcproto.Icon {
+	if len(set.icons) == 0 {
+		return ""
+	}
+	idx := atomic.AddUint32(set.next, 1) - 1
+	return set.icons[idx%uint32(len(set.icons))]
+}
+
+// PlayersRewrite changes player count and list in status responses. online
+// is a number, or "proxied" for players proxied by MineGate, max is a number,
+// or "+N" for N more than online. sample replaces player list, which is
+// removed by hide_sample.
+type PlayersRewrite struct {
+	Online     string        `yaml:"online"`
+	Max        string        `yaml:"max"`
+	Sample     []ChatMessage `yaml:"sample"`
+	HideSample bool          `yaml:"hide_sample"`
+	sample     []mcproto.StatusPlayer
+}
+
+func (players *PlayersRewrite) Validate() (valid bool) {
+	players.Online = strings.ToLower(strings.TrimSpace(players.Online))
+	if players.Online != "" && players.Online != "proxied" {
+		if _, err := strconv.Atoi(players.Online); err != nil {
+			log.Errorf("Invalid online players %s", players.Online)
+			return false
+		}
+	}
+	players.Max = strings.TrimSpace(players.Max)
+	if players.Max != "" {
+		if _, err := strconv.Atoi(players.Max); err != nil {
+			log.Errorf("Invalid max players %s", players.Max)
+			return false
+		}
+	}
+	players.sample = nil
+	for idx := range players.Sample {
+		line := ToChatMsg(&players.Sample[idx]).AsLegacyString()
+		players.sample = append(players.sample, mcproto.StatusPlayer{Name: line, ID: status_sample_id})
+	}
+	return true
+}
+
+func (players *PlayersRewrite) apply(upstream *Upstream, resp *mcproto.MCStatusResponse) {
+	switch players.Online {
+	case "":
+	case "proxied":
+		resp.Players.Online = OnlineCount(upstream.Server)
+	default:
+		resp.Players.Online, _ = strconv.Atoi(players.Online)
+	}
+	if players.Max != "" {
+		max, _ := strconv.Atoi(players.Max)
+		if strings.HasPrefix(players.Max, "+") {
+			max += resp.Players.Online
+		}
+		resp.Players.Max = max
+	}
+	if players.sample != nil {
+		resp.Players.Sample = append([]mcproto.StatusPlayer(nil), players.sample...)
+	} else if players.HideSample {
+		resp.Players.Sample = nil
+	}
+}
+
+// VersionRewrite changes version in status responses. protocol is a number,
+// or "echo" for protocol of client, so it's never shown as outdated. With
+// supported protocols, others are shown as incompatible instead.
+type VersionRewrite struct {
+	Name      string     `yaml:"name"`
+	Protocol  string     `yaml:"protocol"`
+	Supported StringList `yaml:"supported"`
+	supported RangeList
+}
+
+func (version *VersionRewrite) Validate() (valid bool) {
+	version.Protocol = strings.ToLower(strings.TrimSpace(version.Protocol))
+	if version.Protocol != "" && version.Protocol != "echo" {
+		if _, err := strconv.Atoi(version.Protocol); err != nil {
+			log.Errorf("Invalid version protocol %s", version.Protocol)
+			return false
+		}
+	}
+	var err error
+	if version.supported, err = ParseRangeList(version.Supported, 0); err != nil {
+		log.Errorf("Invalid supported protocols: %s", err.Error())
+		return false
+	}
+	if len(version.supported) != 0 {
+		if version.Protocol == "" {
+			version.Protocol = "echo"
+		} else if version.Protocol != "echo" {
+			log.Warnf("Supported protocols are ignored with protocol %s", version.Protocol)
+		}
+	}
+	return true
+}
+
+func (version *VersionRewrite) apply(resp *mcproto.MCStatusResponse, proto uint64) {
+	if version.Name != "" {
+		resp.Version.Name = version.Name
+	}
+	switch version.Protocol {
+	case "":
+	case "echo":
+		if version.supported.Contains(proto) {
+			resp.Version.Protocol = int(proto)
+		} else {
+			resp.Version.Protocol = -1
+		}
+	default:
+		resp.Version.Protocol, _ = strconv.Atoi(version.Protocol)
+	}
+}
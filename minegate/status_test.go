@@ -0,0 +1,453 @@
+package minegate
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/jackyyf/MineGate-Go/mcchat"
+	"github.com/jackyyf/MineGate-Go/mcproto"
+	log "github.com/jackyyf/golog"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeStatusServer answers status requests slowly with protocol of client,
+// and counts connections.
+func fakeStatusServer(t *testing.T) (listener net.Listener, count *int32) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err.Error())
+	}
+	count = new(int32)
+	go func() {
+		for {
+			sock, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(count, 1)
+			go func(sock net.Conn) {
+				defer sock.Close()
+				reader := bufio.NewReader(sock)
+				pkt, err := mcproto.ReadPacket(reader)
+				if err != nil {
+					return
+				}
+				handshake, err := pkt.ToHandShake()
+				if err != nil {
+					return
+				}
+				if _, err := mcproto.ReadPacket(reader); err != nil {
+					return
+				}
+				time.Sleep(100 * time.Millisecond)
+				resp := new(mcproto.MCStatusResponse)
+				resp.Version.Name = "backend"
+				resp.Version.Protocol = int(handshake.Proto)
+				resp.Players.Max = 20
+				resp.Description = mcchat.NewMsg("Hello")
+				resp.Favicon = "data:image/png;base64,AAAA"
+				pkt, _ = resp.ToRawPacket()
+				sock.Write(pkt.ToBytes())
+			}(sock)
+		}
+	}()
+	return
+}
+
+func TestStatusCache(t *testing.T) {
+	defer func() {
+		if r := recover(); r != nil {
+			t.Fatalf("Recovered from panic: %s", r)
+			return
+		}
+	}()
+	log.SetLogLevel(log.FATAL)
+	listener, count := fakeStatusServer(t)
+	defer listener.Close()
+	handshake := &mcproto.MCHandShake{Proto: 47, ServerAddr: "status.example.com", ServerPort: 25565, NextState: 1}
+	upstream, err := NewUpstream(listener.Addr().String(), "")
+	if err != nil {
+		t.Fatalf("Unable to create upstream: %s", err.Error())
+		return
+	}
+	var wg sync.WaitGroup
+	resps := make([]*mcproto.MCStatusResponse, 5)
+	for i := range resps {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			resps[i], _ = fetchStatus(0, upstream, handshake)
+		}(i)
+	}
+	wg.Wait()
+	if n := atomic.LoadInt32(count); n != 1 {
+		t.Errorf("Concurrent pings should be coalesced, %d requests made", n)
+	}
+	for i, resp := range resps {
+		if resp == nil || resp.Version.Name != "backend" {
+			t.Fatalf("Invalid response #%d: %+v", i, resp)
+			return
+		}
+	}
+	if resps[0].Favicon != "" {
+		t.Error("Broken favicon from upstream should be dropped")
+	}
+	resps[0].Description.Text = "Changed"
+	if resps[1].Description.Text != "Hello" {
+		t.Error("Clients should get their own copy of response")
+	}
+	fetchStatus(0, upstream, handshake)
+	if n := atomic.LoadInt32(count); n != 2 {
+		t.Errorf("Response should not be cached without status_cache, %d requests made", n)
+	}
+	upstream.StatusCache = 60
+	fetchStatus(0, upstream, handshake)
+	fetchStatus(0, upstream, handshake)
+	if n := atomic.LoadInt32(count); n != 3 {
+		t.Errorf("Response should be cached, %d requests made", n)
+	}
+	handshake.Proto = 340
+	fetchStatus(0, upstream, handshake)
+	if n := atomic.LoadInt32(count); n != 4 {
+		t.Errorf("Different handshake should not share cache, %d requests made", n)
+	}
+	if !t.Failed() {
+		t.Log("Ok, status requests coalesced and cached.")
+	}
+}
+
+func TestStatusProtocols(t *testing.T) {
+	defer func() {
+		if r := recover(); r != nil {
+			t.Fatalf("Recovered from panic: %s", r)
+			return
+		}
+	}()
+	log.SetLogLevel(log.FATAL)
+	status_lock.Lock()
+	status_cache = make(map[statusKey]*statusEntry)
+	status_lock.Unlock()
+	listener, count := fakeStatusServer(t)
+	defer listener.Close()
+	upstream, err := NewUpstream(listener.Addr().String(), "")
+	if err != nil {
+		t.Fatalf("Unable to create upstream: %s", err.Error())
+		return
+	}
+	var wg sync.WaitGroup
+	var flight, max_flight int32
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(proto uint64) {
+			defer wg.Done()
+			handshake := &mcproto.MCHandShake{Proto: proto, ServerAddr: "Flood.Example.com.", ServerPort: uint16(proto), NextState: 1}
+			resp, _ := fetchStatus(0, upstream, handshake)
+			if resp == nil || resp.Version.Protocol != int(proto) {
+				t.Errorf("Invalid response for protocol %d: %+v", proto, resp)
+			}
+		}(uint64(1000 + i%10))
+	}
+	// Requests in flight are limited.
+	for i := 0; i < 20; i++ {
+		status_lock.Lock()
+		if entry := status_cache[statusKey{upstream.Server, "flood.example.com"}]; entry != nil {
+			flight = 0
+			for _, call := range entry.calls {
+				if !call.finished() {
+					flight++
+				}
+			}
+			if flight > max_flight {
+				max_flight = flight
+			}
+		}
+		status_lock.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+	wg.Wait()
+	if n := atomic.LoadInt32(count); n != 10 {
+		t.Errorf("Concurrent pings should be coalesced by protocol, %d requests made for 10 protocols", n)
+	}
+	if max_flight > status_protocols {
+		t.Errorf("%d requests in flight, at most %d expected", max_flight, status_protocols)
+	}
+	upstream.StatusCache = 60
+	for i := 0; i < 2*status_protocols; i++ {
+		handshake := &mcproto.MCHandShake{Proto: uint64(2000 + i), ServerAddr: "flood.example.com", ServerPort: 25565, NextState: 1}
+		if resp, _ := fetchStatus(0, upstream, handshake); resp == nil || resp.Version.Protocol != 2000+i {
+			t.Fatalf("Invalid response for protocol %d: %+v", handshake.Proto, resp)
+			return
+		}
+	}
+	status_lock.Lock()
+	entries := len(status_cache)
+	cached := len(status_cache[statusKey{upstream.Server, "flood.example.com"}].calls)
+	status_lock.Unlock()
+	if cached > status_protocols {
+		t.Errorf("%d protocols cached, at most %d expected", cached, status_protocols)
+	}
+	if entries > 2 {
+		t.Errorf("%d cache entries found, should be kept by upstream and hostname", entries)
+	}
+	if !t.Failed() {
+		t.Log("Ok, status requests coalesced and cached by protocol.")
+	}
+}
+
+func TestStaticStatus(t *testing.T) {
+	defer func() {
+		if r := recover(); r != nil {
+			t.Fatalf("Recovered from panic: %s", r)
+			return
+		}
+	}()
+	defer os.Remove("static_status.yml")
+	defer os.Remove("static_status.png")
+	log.SetLogLevel(log.FATAL)
+	defer os.Remove("static_status_red.png")
+	for file, c := range map[string]color.RGBA{
+		"static_status.png":     {0, 0, 255, 255},
+		"static_status_red.png": {255, 0, 0, 255},
+	} {
+		img := image.NewRGBA(image.Rect(0, 0, 128, 128))
+		for i := 0; i < len(img.Pix); i += 4 {
+			img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3] = c.R, c.G, c.B, c.A
+		}
+		buff := new(bytes.Buffer)
+		png.Encode(buff, img)
+		if err := ioutil.WriteFile(file, buff.Bytes(), 0644); err != nil {
+			t.Fatal("Unable to write to " + file)
+			return
+		}
+	}
+	if err := ioutil.WriteFile("static_status.yml", []byte(
+		`
+listen: ':25565'
+upstreams:
+- hostname: private.example.com
+  upstream: 127.0.0.1:1
+  status:
+    version: Private
+    max_players: 10
+    online: 2
+    sample: [Alice, Bob]
+    description:
+      text: Invite only
+      color: gold
+    favicon: static_status.png
+- hostname: fixed.example.com
+  upstream: 127.0.0.1:1
+  favicon: [static_status.png, static_status_red.png]
+  status:
+    protocol: 47`), 0644); err != nil {
+		t.Fatal("Unable to write to static_status.yml")
+		return
+	}
+	SetConfig("static_status.yml")
+	confInit()
+	if len(config.Upstream) != 2 {
+		t.Fatalf("There should be 2 valid upstreams, %d found", len(config.Upstream))
+		return
+	}
+	handshake := &mcproto.MCHandShake{Proto: 340, ServerAddr: "private.example.com", ServerPort: 25565, NextState: 1}
+	upstream, _ := MatchUpstream("private.example.com")
+	resp, err := upstream.Status.Response(handshake)
+	if err != nil {
+		t.Fatalf("Unable to build static status: %s", err.Error())
+		return
+	}
+	if resp.Version.Name != "Private" || resp.Version.Protocol != 340 {
+		t.Errorf("Invalid version: %+v", resp.Version)
+	}
+	if resp.Players.Max != 10 || resp.Players.Online != 2 || len(resp.Players.Sample) != 2 ||
+		resp.Players.Sample[1].Name != "Bob" {
+		t.Errorf("Invalid players: %+v", resp.Players)
+	}
+	if resp.Description == nil || resp.Description.Text != "Invite only" {
+		t.Errorf("Invalid description: %+v", resp.Description)
+	}
+	if err = resp.Favicon.Validate(); err != nil {
+		t.Errorf("Invalid favicon: %s", err.Error())
+	}
+	resp.Description.Text = "Changed"
+	if resp, _ = upstream.Status.Response(handshake); resp.Description.Text != "Invite only" {
+		t.Error("Static status should not be changed by clients")
+	}
+	upstream, _ = MatchUpstream("fixed.example.com")
+	if resp, _ = upstream.Status.Response(handshake); resp.Version.Protocol != 47 {
+		t.Errorf("Protocol should be 47, %d found", resp.Version.Protocol)
+	}
+	first, second := upstream.icons.pick(), upstream.icons.pick()
+	if first == "" || second == "" || first == second || upstream.icons.pick() != first {
+		t.Error("Favicons should be rotated")
+	}
+	if !t.Failed() {
+		t.Log("Ok, static status answered.")
+	}
+}
+
+func TestPlayersRewrite(t *testing.T) {
+	defer func() {
+		if r := recover(); r != nil {
+			t.Fatalf("Recovered from panic: %s", r)
+			return
+		}
+	}()
+	defer os.Remove("players_rewrite.yml")
+	log.SetLogLevel(log.FATAL)
+	if err := ioutil.WriteFile("players_rewrite.yml", []byte(
+		`
+listen: ':25565'
+upstreams:
+- hostname: proxied.example.com
+  upstream: 127.0.0.1:25590
+  status:
+    online: 50
+    max_players: 100
+    sample: [Alice, Bob]
+  players:
+    online: proxied
+    max: '+1'
+    sample:
+    - text: Welcome
+      color: gold
+      bold: true
+    - text: Have fun
+- hostname: hidden.example.com
+  upstream: 127.0.0.1:25591
+  status:
+    online: 50
+    max_players: 100
+    sample: [Alice, Bob]
+  players:
+    max: 200
+    hide_sample: true
+- hostname: invalid.example.com
+  upstream: 127.0.0.1:25592
+  players:
+    online: many`), 0644); err != nil {
+		t.Fatal("Unable to write to players_rewrite.yml")
+		return
+	}
+	SetConfig("players_rewrite.yml")
+	confInit()
+	if len(config.Upstream) != 2 {
+		t.Fatalf("There should be 2 valid upstreams, %d found", len(config.Upstream))
+		return
+	}
+	sessionStart("127.0.0.1:25590")
+	sessionStart("127.0.0.1:25590")
+	sessionStart("127.0.0.1:25590")
+	sessionEnd("127.0.0.1:25590")
+	handshake := &mcproto.MCHandShake{Proto: 47, ServerAddr: "proxied.example.com", ServerPort: 25565, NextState: 1}
+	upstream, _ := MatchUpstream("proxied.example.com")
+	resp, err := FetchStatus(0, upstream, handshake)
+	if err != nil {
+		t.Fatalf("Unable to get status: %s", err.Error())
+		return
+	}
+	if resp.Players.Online != 2 || resp.Players.Max != 3 {
+		t.Errorf("Players should be 2/3, %d/%d found", resp.Players.Online, resp.Players.Max)
+	}
+	if len(resp.Players.Sample) != 2 || resp.Players.Sample[0].Name != "§6§lWelcome" ||
+		resp.Players.Sample[1].Name != "Have fun" {
+		t.Errorf("Invalid sample: %+v", resp.Players.Sample)
+	}
+	upstream, _ = MatchUpstream("hidden.example.com")
+	if resp, _ = FetchStatus(0, upstream, handshake); resp.Players.Online != 50 ||
+		resp.Players.Max != 200 || len(resp.Players.Sample) != 0 {
+		t.Errorf("Invalid players: %+v", resp.Players)
+	}
+	sessionEnd("127.0.0.1:25590")
+	sessionEnd("127.0.0.1:25590")
+	if OnlineCount("127.0.0.1:25590") != 0 {
+		t.Error("Sessions should be ended")
+	}
+	if !t.Failed() {
+		t.Log("Ok, players rewritten.")
+	}
+}
+
+func TestVersionRewrite(t *testing.T) {
+	defer func() {
+		if r := recover(); r != nil {
+			t.Fatalf("Recovered from panic: %s", r)
+			return
+		}
+	}()
+	defer os.Remove("version_rewrite.yml")
+	log.SetLogLevel(log.FATAL)
+	if err := ioutil.WriteFile("version_rewrite.yml", []byte(
+		`
+listen: ':25565'
+upstreams:
+- hostname: multi.example.com
+  upstream: 127.0.0.1:25590
+  status:
+    version: Spigot 1.20
+    protocol: 763
+  version:
+    name: '1.8-1.20'
+    supported: [47, 340-763]
+- hostname: echo.example.com
+  upstream: 127.0.0.1:25591
+  status:
+    protocol: 763
+  version:
+    protocol: echo
+- hostname: fixed.example.com
+  upstream: 127.0.0.1:25592
+  status:
+    protocol: 763
+  version:
+    protocol: 47
+- hostname: invalid.example.com
+  upstream: 127.0.0.1:25593
+  version:
+    supported: 340-47`), 0644); err != nil {
+		t.Fatal("Unable to write to version_rewrite.yml")
+		return
+	}
+	SetConfig("version_rewrite.yml")
+	confInit()
+	if len(config.Upstream) != 3 {
+		t.Fatalf("There should be 3 valid upstreams, %d found", len(config.Upstream))
+		return
+	}
+	cases := []struct {
+		hostname string
+		proto    uint64
+		name     string
+		expected int
+	}{
+		{"multi.example.com", 47, "1.8-1.20", 47},
+		{"multi.example.com", 500, "1.8-1.20", 500},
+		{"multi.example.com", 107, "1.8-1.20", -1},
+		{"echo.example.com", 5, "minegate", 5},
+		{"fixed.example.com", 340, "minegate", 47},
+	}
+	for _, c := range cases {
+		handshake := &mcproto.MCHandShake{Proto: c.proto, ServerAddr: c.hostname, ServerPort: 25565, NextState: 1}
+		upstream, _ := MatchUpstream(c.hostname)
+		resp, err := FetchStatus(0, upstream, handshake)
+		if err != nil {
+			t.Errorf("Unable to get status of %s: %s", c.hostname, err.Error())
+			continue
+		}
+		if resp.Version.Name != c.name || resp.Version.Protocol != c.expected {
+			t.Errorf("%s with protocol %d: version should be %s (%d), %s (%d) found", c.hostname, c.proto,
+				c.name, c.expected, resp.Version.Name, resp.Version.Protocol)
+		}
+	}
+	if !t.Failed() {
+		t.Log("Ok, version rewritten.")
+	}
+}
@@ -0,0 +1,184 @@
+package minegate
+
+import (
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Placeholders like {1} are replaced with the text captured by the first
+// wildcard (or regex group) of the matched hostname pattern, {0} is the whole
+// hostname.
+var template_placeholder = regexp.MustCompile(`\{([0-9]+)\}`)
+
+// Used to check templated upstream addresses when loading config, digits are
+// valid as both host label and port.
+var template_probe = []string{"0", "1", "2", "3", "4", "5", "6", "7", "8", "9"}
+
+func IsTemplate(s string) bool {
+	return template_placeholder.MatchString(s)
+}
+
+func ExpandTemplate(s string, captures []string) string {
+	if !strings.Contains(s, "{") {
+		return s
+	}
+	return template_placeholder.ReplaceAllStringFunc(s, func(placeholder string) string {
+		idx, err := strconv.Atoi(placeholder[1 : len(placeholder)-1])
+		if err != nil || idx >= len(captures) {
+			return ""
+		}
+		return captures[idx]
+	})
+}
+
+// globCapture works like path.Match, but also returns text matched by each *,
+// ? and [...] in pattern. * matches as few characters as possible, dots
+// included, so it may capture several labels. With nonempty, * matches at
+// least one character, so no capture is empty.
+func globCapture(pattern, name string, nonempty bool) (captures []string, ok bool) {
+	var tokens []string
+	for i := 0; i < len(pattern); {
+		end := i + 1
+		if pattern[i] == '[' {
+			if end = strings.IndexByte(pattern[i:], ']') + 1; end == 0 {
+				return nil, false
+			}
+			end += i
+		}
+		tokens = append(tokens, pattern[i:end])
+		i = end
+	}
+	// matched[i][j] tells whether tokens[i:] match name[j:], which is found
+	// backwards, so it takes O(len(tokens) * len(name)) without backtracking.
+	size := func(j int) int {
+		_, size := utf8.DecodeRuneInString(name[j:])
+		return size
+	}
+	matched := make([][]bool, len(tokens)+1)
+	for i := range matched {
+		matched[i] = make([]bool, len(name)+1)
+	}
+	matched[len(tokens)][len(name)] = true
+	for i := len(tokens) - 1; i >= 0; i-- {
+		if tokens[i] == "*" && !nonempty {
+			matched[i][len(name)] = matched[i+1][len(name)]
+		}
+		for j := len(name) - 1; j >= 0; j-- {
+			switch token := tokens[i]; token[0] {
+			case '*':
+				matched[i][j] = matched[i][j+1] || matched[i+1][j+1]
+				if !nonempty {
+					matched[i][j] = matched[i][j] || matched[i+1][j]
+				}
+			case '?', '[':
+				end := j + size(j)
+				ok, _ := path.Match(token, name[j:end])
+				matched[i][j] = ok && matched[i+1][end]
+			default:
+				matched[i][j] = name[j] == token[0] && matched[i+1][j+1]
+			}
+		}
+	}
+	if !matched[0][0] {
+		return nil, false
+	}
+	j := 0
+	for i, token := range tokens {
+		switch token[0] {
+		case '*':
+			end := j
+			if nonempty {
+				end++
+			}
+			for !matched[i+1][end] {
+				end++
+			}
+			captures = append(captures, name[j:end])
+			j = end
+		case '?', '[':
+			captures = append(captures, name[j:j+size(j)])
+			j += size(j)
+		default:
+			j++
+		}
+	}
+	return captures, true
+}
+
+func expandValue(val interface{}, captures []string) interface{} {
+	switch val := val.(type) {
+	case string:
+		return ExpandTemplate(val, captures)
+	case []interface{}:
+		res := make([]interface{}, len(val))
+		for idx, v := range val {
+			res[idx] = expandValue(v, captures)
+		}
+		return res
+	case map[interface{}]interface{}:
+		res := make(map[interface{}]interface{}, len(val))
+		for k, v := range val {
+			res[k] = expandValue(v, captures)
+		}
+		return res
+	case map[string]interface{}:
+		res := make(map[string]interface{}, len(val))
+		for k, v := range val {
+			res[k] = expandValue(v, captures)
+		}
+		return res
+	default:
+		return val
+	}
+}
+
+func templatedValue(val interface{}) bool {
+	switch val := val.(type) {
+	case string:
+		return IsTemplate(val)
+	case []interface{}:
+		for _, v := range val {
+			if templatedValue(v) {
+				return true
+			}
+		}
+	case map[interface{}]interface{}:
+		for _, v := range val {
+			if templatedValue(v) {
+				return true
+			}
+		}
+	case map[string]interface{}:
+		for _, v := range val {
+			if templatedValue(v) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// expand returns a copy of upstream with captures substituted into server
+// address, error message and extra fields. Upstream without any placeholder
+// is returned as is.
+func (upstream *Upstream) expand(captures []string) (res *Upstream, err error) {
+	if !upstream.templated {
+		return upstream, nil
+	}
+	res = new(Upstream)
+	*res = *upstream
+	res.Server, err = normalizeServer(ExpandTemplate(upstream.Server, captures))
+	if err != nil {
+		return nil, err
+	}
+	res.ErrorMsg.Text = ExpandTemplate(upstream.ErrorMsg.Text, captures)
+	res.ErrorMsg.Hover = ExpandTemplate(upstream.ErrorMsg.Hover, captures)
+	res.ErrorMsg.Click = ExpandTemplate(upstream.ErrorMsg.Click, captures)
+	res.ChatMsg = ToChatMsg(&res.ErrorMsg)
+	res.Rewrite.Hostname = ExpandTemplate(upstream.Rewrite.Hostname, captures)
+	res.Extras = expandValue(upstream.Extras, captures).(map[string]interface{})
+	return res, nil
+}
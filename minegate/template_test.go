@@ -0,0 +1,69 @@
+package minegate
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGlobCapture(t *testing.T) {
+	defer func() {
+		if r := recover(); r != nil {
+			t.Fatalf("Recovered from panic: %s", r)
+			return
+		}
+	}()
+	cases := []struct {
+		pattern  string
+		name     string
+		nonempty bool
+		captures []string
+		ok       bool
+	}{
+		{"*.example.com", "alice.example.com", true, []string{"alice"}, true},
+		{"*.example.com", "a.b.example.com", true, []string{"a.b"}, true},
+		{"*.example.com", ".example.com", true, nil, false},
+		{"*.example.com", ".example.com", false, []string{""}, true},
+		{"*.example.com", "example.com", false, nil, false},
+		{"play*.example.com", "play.example.com", false, []string{""}, true},
+		{"play*.example.com", "play2.example.com", false, []string{"2"}, true},
+		{"*-*.example.com", "a-b-c.example.com", true, []string{"a", "b-c"}, true},
+		{"*-*.example.com", "a-b-c.example.com", false, []string{"a", "b-c"}, true},
+		{"*-*.example.com", "-b.example.com", true, nil, false},
+		{"*-*.example.com", "-b.example.com", false, []string{"", "b"}, true},
+		{"*-*.example.com", "a-.example.com", true, nil, false},
+		{"s?.[a-c]*.net", "s1.bob.net", true, []string{"1", "b", "ob"}, true},
+		{"s?.[a-c]*.net", "s1.b.net", true, nil, false},
+		{"s?.[a-c]*.net", "s1.b.net", false, []string{"1", "b", ""}, true},
+		{"s?.[a-c]*.net", "s1.dan.net", false, nil, false},
+		{"?.example.com", "é.example.com", true, []string{"é"}, true},
+		{"[a-.example.com", "a.example.com", false, nil, false},
+		{"*", "", true, nil, false},
+		{"*", "", false, []string{""}, true},
+		{"**", "ab", false, []string{"", "ab"}, true},
+		{"", "", true, nil, true},
+	}
+	for idx, c := range cases {
+		captures, ok := globCapture(c.pattern, c.name, c.nonempty)
+		if ok != c.ok || len(captures) != len(c.captures) ||
+			strings.Join(captures, "|") != strings.Join(c.captures, "|") {
+			t.Errorf("Case %d: %s on %s got %q (%v), %q (%v) expected", idx, c.pattern, c.name, captures, ok,
+				c.captures, c.ok)
+		}
+	}
+	// Backtracking would take ages here.
+	pattern := strings.Repeat("*a", 20) + "b"
+	name := strings.Repeat("a", 250)
+	start := time.Now()
+	for _, nonempty := range []bool{true, false} {
+		if _, ok := globCapture(pattern, name, nonempty); ok {
+			t.Errorf("%s should not match %s", pattern, name)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Matching took %s", elapsed)
+	}
+	if !t.Failed() {
+		t.Log("Ok, wildcards captured.")
+	}
+}
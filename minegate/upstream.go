@@ -6,9 +6,10 @@ import (
 	"fmt"
 	"github.com/jackyyf/MineGate-Go/mcchat"
 	log "github.com/jackyyf/golog"
+	"golang.org/x/net/idna"
 	"net"
-	"path"
 	"reflect"
+	"regexp"
 	"strconv"
 	"strings"
 )
@@ -24,43 +25,160 @@ type ChatMessage struct {
 	Click         string
 }
 
+// StringList accepts either a single value or a list of them.
+type StringList []string
+
+// HandshakeRewrite changes the handshake sent to upstream. Hostname and port
+// are kept as sent by client when empty, and "upstream" means host (port) of
+// the upstream server. Data after hostname (FML markers, forwarding data) is
+// kept, unless fml is "strip", which removes FML markers.
+type HandshakeRewrite struct {
+	Hostname string `yaml:"hostname"`
+	Port     string `yaml:"port"`
+	FML      string `yaml:"fml"`
+}
+
 type Upstream struct {
-	Pattern  string                 `yaml:"hostname"`
-	Server   string                 `yaml:"upstream"`
-	ErrorMsg ChatMessage            `yaml:"onerror"`
-	ChatMsg  *mcchat.ChatMsg        `yaml:"-"`
-	Extras   map[string]interface{} `yaml:",inline"`
+	Name        string                 `yaml:"name"`
+	Patterns    StringList             `yaml:"hostname"`
+	Ports       StringList             `yaml:"port"`
+	Protocols   StringList             `yaml:"protocol"`
+	Sources     StringList             `yaml:"source"`
+	Countries   StringList             `yaml:"country"`
+	Continents  StringList             `yaml:"continent"`
+	Server      string                 `yaml:"upstream"`
+	ErrorMsg    ChatMessage            `yaml:"onerror"`
+	Rewrite     HandshakeRewrite       `yaml:"rewrite"`
+	StatusCache uint                   `yaml:"status_cache"`
+	Status      *StaticStatus          `yaml:"status"`
+	Favicon     StringList             `yaml:"favicon"`
+	Players     PlayersRewrite         `yaml:"players"`
+	Version     VersionRewrite         `yaml:"version"`
+	Maintenance MaintenanceOptions     `yaml:"maintenance"`
+	Schedules   []*Schedule            `yaml:"schedules"`
+	MaxPlayers  uint                   `yaml:"max_players"`
+	Queue       *QueueOptions          `yaml:"queue"`
+	JoinCodes   *JoinCodeOptions       `yaml:"join_codes"`
+	ChatMsg     *mcchat.ChatMsg        `yaml:"-"`
+	Extras      map[string]interface{} `yaml:",inline"`
+	// Deprecated: the first of Patterns, filled in by Validate. Upstreams
+	// without Patterns get this one.
+	Pattern string `yaml:"-"`
+	// Server, error message, rewrite or extras contains capture placeholders.
+	templated  bool
+	ports      RangeList
+	protocols  RangeList
+	sources    []*net.IPNet
+	countries  map[string]bool
+	continents map[string]bool
+	icons      iconSet
+	// Set by schedules.
+	scheduleApplied bool
+	loginClosed     *mcchat.ChatMsg
+	motd            *mcchat.ChatMsg
 }
 
-var valid_host = []byte("0123456789abcdefgijklmnopqrstuvwxyz.-:[]")
-var valid_pattern = []byte("0123456789abcdefgijklmnopqrstuvwxyz.-:*?[]")
+var valid_host = []byte("0123456789abcdefghijklmnopqrstuvwxyz.-:[]")
+var valid_pattern = []byte("0123456789abcdefghijklmnopqrstuvwxyz.-:*?[]")
 
-func (upstream *Upstream) Validate() (valid bool) {
-	var host, port string
-	host, port, err := net.SplitHostPort(upstream.Server)
+func (list *StringList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var single string
+	if err := unmarshal(&single); err == nil {
+		*list = StringList{single}
+		return nil
+	}
+	var multi []string
+	if err := unmarshal(&multi); err != nil {
+		return err
+	}
+	*list = StringList(multi)
+	return nil
+}
+
+// normalizeServer checks host and port of server, and fills in the default
+// port 25565 when missing.
+func normalizeServer(server string) (normalized string, err error) {
+	host, port, err := net.SplitHostPort(server)
 	if err != nil {
-		server := upstream.Server + ":25565"
-		if host, port, err = net.SplitHostPort(server); err != nil {
-			log.Error("Invalid upstream server: " + upstream.Server)
-			return false
+		if host, port, err = net.SplitHostPort(server + ":25565"); err != nil {
+			return "", err
 		}
-		log.Infof("no port information found in %s, assume 25565", upstream.Server)
-		upstream.Server = server
 	}
 	p, err := strconv.ParseUint(port, 10, 16)
 	if err != nil {
-		log.Errorf("Invalid port %s: %s", port, err.Error())
-		return false
+		return "", fmt.Errorf("invalid port %s: %s", port, err.Error())
 	}
 	host = strings.ToLower(host)
 	if !CheckHost(host) {
-		log.Error("Invalid upstream host: " + host)
+		return "", errors.New("invalid host " + host)
+	}
+	return net.JoinHostPort(host, fmt.Sprintf("%d", p)), nil
+}
+
+func (upstream *Upstream) Validate() (valid bool) {
+	if _, _, err := net.SplitHostPort(upstream.Server); err != nil {
+		log.Infof("no port information found in %s, assume 25565", upstream.Server)
+	}
+	upstream.templated = IsTemplate(upstream.Server)
+	if upstream.templated {
+		// Captured labels are only known when routing, check with a probe.
+		if _, err := normalizeServer(ExpandTemplate(upstream.Server, template_probe)); err != nil {
+			log.Errorf("Invalid upstream server template %s: %s", upstream.Server, err.Error())
+			return false
+		}
+		if _, _, err := net.SplitHostPort(upstream.Server); err != nil {
+			upstream.Server += ":25565"
+		}
+		upstream.Server = strings.ToLower(upstream.Server)
+	} else {
+		server, err := normalizeServer(upstream.Server)
+		if err != nil {
+			log.Errorf("Invalid upstream server %s: %s", upstream.Server, err.Error())
+			return false
+		}
+		upstream.Server = server
+	}
+	if len(upstream.Patterns) == 0 && upstream.Pattern != "" {
+		upstream.Patterns = StringList{upstream.Pattern}
+	}
+	for idx, pattern := range upstream.Patterns {
+		if IsRegexPattern(pattern) {
+			if _, err := regexp.Compile(pattern[1:]); err != nil {
+				log.Errorf("Invalid regex pattern %s: %s", pattern, err.Error())
+				return false
+			}
+			continue
+		}
+		pattern = NormalizeHost(pattern)
+		if !CheckPattern(pattern) {
+			log.Error("Invalid pattern: " + pattern)
+			return false
+		}
+		upstream.Patterns[idx] = pattern
+	}
+	if len(upstream.Patterns) != 0 {
+		upstream.Pattern = upstream.Patterns[0]
+	}
+	var err error
+	if upstream.ports, err = ParseRangeList(upstream.Ports, 65535); err != nil {
+		log.Errorf("Invalid port for %s: %s", upstream.Server, err.Error())
 		return false
 	}
-	upstream.Server = net.JoinHostPort(host, fmt.Sprintf("%d", p))
-	upstream.Pattern = strings.ToLower(upstream.Pattern)
-	if !CheckPattern(upstream.Pattern) {
-		log.Error("Invalid pattern: " + upstream.Pattern)
+	if upstream.protocols, err = ParseRangeList(upstream.Protocols, 0); err != nil {
+		log.Errorf("Invalid protocol for %s: %s", upstream.Server, err.Error())
+		return false
+	}
+	if upstream.sources, err = ParseCIDRList(upstream.Sources); err != nil {
+		log.Errorf("Invalid source for %s: %s", upstream.Server, err.Error())
+		return false
+	}
+	var ok bool
+	if upstream.countries, ok = parseCountries(upstream.Countries, false); !ok {
+		log.Errorf("Invalid country for %s", upstream.Server)
+		return false
+	}
+	if upstream.continents, ok = parseCountries(upstream.Continents, true); !ok {
+		log.Errorf("Invalid continent for %s", upstream.Server)
 		return false
 	}
 	if upstream.ErrorMsg.Text == "" {
@@ -68,6 +186,45 @@ func (upstream *Upstream) Validate() (valid bool) {
 		upstream.ErrorMsg.Text = "Connection failed to " + upstream.Server
 	}
 	upstream.ChatMsg = ToChatMsg(&upstream.ErrorMsg)
+	if upstream.Status != nil && !upstream.Status.Validate() {
+		log.Errorf("Invalid static status for %s", upstream.Server)
+		return false
+	}
+	upstream.icons = loadIcons(upstream.Favicon)
+	if !upstream.Players.Validate() {
+		log.Errorf("Invalid players rewrite for %s", upstream.Server)
+		return false
+	}
+	if !upstream.Version.Validate() {
+		log.Errorf("Invalid version rewrite for %s", upstream.Server)
+		return false
+	}
+	if !upstream.Maintenance.Validate() {
+		log.Errorf("Invalid maintenance options for %s", upstream.Server)
+		return false
+	}
+	for _, schedule := range upstream.Schedules {
+		if !schedule.Validate() {
+			log.Errorf("Invalid schedule for %s", upstream.Server)
+			return false
+		}
+	}
+	if upstream.Queue != nil && !upstream.Queue.Validate() {
+		log.Errorf("Invalid queue options for %s", upstream.Server)
+		return false
+	}
+	if upstream.JoinCodes != nil && !upstream.JoinCodes.Validate() {
+		log.Errorf("Invalid join codes for %s", upstream.Server)
+		return false
+	}
+	if !upstream.Rewrite.Validate() {
+		log.Errorf("Invalid handshake rewrite for %s", upstream.Server)
+		return false
+	}
+	upstream.templated = upstream.templated || IsTemplate(upstream.Rewrite.Hostname) ||
+		IsTemplate(upstream.ErrorMsg.Text) ||
+		IsTemplate(upstream.ErrorMsg.Hover) || IsTemplate(upstream.ErrorMsg.Click) ||
+		templatedValue(upstream.Extras)
 	return true
 }
 
@@ -130,17 +287,150 @@ func CheckPattern(pattern string) (valid bool) {
 	return true
 }
 
-func GetUpstream(hostname string) (upstream *Upstream, err *mcchat.ChatMsg) {
+// Regex patterns are written with a leading ~, e.g. ~^play[0-9]+\.example\.net$
+func IsRegexPattern(pattern string) bool {
+	return strings.HasPrefix(pattern, "~")
+}
+
+// NormalizeHost turns a hostname sent by client (or written in config) into
+// the form used for matching: lower case, no trailing dot, no FML / forwarding
+// data after NUL, and internationalized labels converted to punycode.
+func NormalizeHost(host string) string {
+	if idx := strings.IndexByte(host, 0); idx != -1 {
+		host = host[:idx]
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if ascii, err := idna.ToASCII(host); err == nil {
+		host = strings.ToLower(ascii)
+	}
+	return host
+}
+
+// lookup finds upstream for req in table, with placeholders expanded.
+func (table *routeTable) lookup(req *RouteRequest) (upstream *Upstream, rule string) {
+	hostname := NormalizeHost(req.Hostname)
+	r, captures := table.match(hostname, req)
+	if r == nil {
+		return nil, ""
+	}
+	upstream, err := r.Upstream.expand(captures)
+	if err != nil {
+		log.Errorf("Unable to expand upstream %s for %s: %s", r.Upstream.Server, hostname, err.Error())
+		return nil, ""
+	}
+	return upstream, r.String()
+}
+
+func matchStatic(req *RouteRequest) (upstream *Upstream, rule string) {
+	config_lock.Lock()
+	table := config.routes
+	config_lock.Unlock()
+	return table.lookup(req)
+}
+
+// MatchRoute looks up the upstream for req from each route provider in turn,
+// and describes the rule which matched it, which is useful to debug routing.
+func MatchRoute(req *RouteRequest) (upstream *Upstream, rule string) {
+	config_lock.Lock()
+	providers := config.providers
+	config_lock.Unlock()
+	for _, provider := range providers {
+		if _, ok := provider.(staticProvider); ok {
+			if upstream, rule = matchStatic(req); upstream != nil {
+				return
+			}
+			continue
+		}
+		upstream, err := provider.Lookup(req)
+		if err != nil {
+			log.Warnf("route provider %s: %s", provider.Name(), err.Error())
+			continue
+		}
+		if upstream != nil {
+			return upstream, "provider " + provider.Name()
+		}
+	}
+	return nil, ""
+}
+
+func MatchUpstream(hostname string) (upstream *Upstream, rule string) {
+	return MatchRoute(&RouteRequest{Hostname: hostname})
+}
+
+func RouteUpstream(req *RouteRequest) (upstream *Upstream, err *mcchat.ChatMsg) {
+	log.Debugf("hostname=%s port=%d protocol=%d source=%s", req.Hostname, req.Port, req.Proto, req.RemoteAddr)
+	upstream, rule := MatchRoute(req)
+	if upstream == nil {
+		log.Warnf("no match for %s", req.Hostname)
+		config_lock.Lock()
+		defer config_lock.Unlock()
+		return nil, config.chatNotFound
+	}
+	log.Infof("matched server: %s (%s)", upstream.Server, rule)
+	return upstream, nil
+}
+
+// NewUpstream builds an upstream at runtime, e.g. by plugins doing their own
+// routing. It's not added to routing table.
+func NewUpstream(server string, errmsg string) (upstream *Upstream, err error) {
+	upstream = new(Upstream)
+	upstream.Server = server
+	upstream.ErrorMsg.Text = errmsg
+	if !upstream.Validate() {
+		return nil, errors.New("invalid upstream " + server)
+	}
+	return upstream, nil
+}
+
+// WithServer returns a copy of upstream connecting to another server, with
+// all other settings kept.
+func (upstream *Upstream) WithServer(server string) (res *Upstream, err error) {
+	server, err = normalizeServer(server)
+	if err != nil {
+		return nil, err
+	}
+	res = new(Upstream)
+	*res = *upstream
+	res.Server = server
+	return res, nil
+}
+
+func (upstream *Upstream) errorMsg() *mcchat.ChatMsg {
+	if upstream.ChatMsg == nil {
+		return mcchat.NewMsg("Connection failed to " + upstream.Server)
+	}
+	return upstream.ChatMsg
+}
+
+// FindUpstream returns the upstream with given name.
+func FindUpstream(name string) (upstream *Upstream) {
 	config_lock.Lock()
 	defer config_lock.Unlock()
-	log.Debugf("hostname=%s", hostname)
-	for _, u := range config.Upstream {
-		log.Debugf("pattern=%s", u.Pattern)
-		if matched, _ := path.Match(u.Pattern, hostname); matched {
-			log.Infof("matched server: %s", u.Server)
-			return u, nil
+	upstream = config.named[name]
+	if upstream == nil {
+		return nil
+	}
+	upstream, err := upstream.expand(nil)
+	if err != nil {
+		log.Errorf("Unable to expand upstream %s: %s", name, err.Error())
+		return nil
+	}
+	return upstream
+}
+
+// Upstreams returns configured upstreams without placeholders, followed by
+// registered ones. They are shared and must not be modified.
+func Upstreams() (upstreams []*Upstream) {
+	config_lock.Lock()
+	for _, upstream := range config.Upstream {
+		if !upstream.templated {
+			upstreams = append(upstreams, upstream)
 		}
 	}
-	log.Warnf("no match for %s", hostname)
-	return nil, config.chatNotFound
+	config_lock.Unlock()
+	return append(upstreams, registeredUpstreams()...)
+}
+
+func GetUpstream(hostname string) (upstream *Upstream, err *mcchat.ChatMsg) {
+	return RouteUpstream(&RouteRequest{Hostname: hostname})
 }
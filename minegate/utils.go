@@ -2,7 +2,9 @@ package minegate
 
 import (
 	"bufio"
+	"crypto/md5"
 	"fmt"
+	"github.com/jackyyf/MineGate-Go/mcproto"
 	log "github.com/jackyyf/golog"
 	"io"
 	"net"
@@ -27,10 +29,14 @@ type WrapedSocket struct {
 var counter uint64 = 0
 
 func WrapUpstreamSocket(conn net.Conn, cws *WrapedSocket) (ws *WrapedSocket) {
+	return wrapUpstreamSocket(conn, cws.Id())
+}
+
+func wrapUpstreamSocket(conn net.Conn, id uint64) (ws *WrapedSocket) {
 	ws = new(WrapedSocket)
 	ws.sock = conn
 	ws.Reader = bufio.NewReader(conn)
-	ws.id = cws.Id()
+	ws.id = id
 	ws.log_prefix = fmt.Sprintf("[#%d %s] ", ws.id, conn.RemoteAddr())
 	ws.client = false
 	return
@@ -224,3 +230,56 @@ func ToString(val interface{}) (res string) {
 		return fmt.Sprintf("%v", val)
 	}
 }
+
+// ParseCIDRList parses a list of CIDRs, plain IP addresses are treated as a
+// single host network.
+func ParseCIDRList(list []string) (nets []*net.IPNet, err error) {
+	nets = make([]*net.IPNet, 0, len(list))
+	for _, val := range list {
+		val = strings.TrimSpace(val)
+		if !strings.Contains(val, "/") {
+			ip := net.ParseIP(val)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %s", val)
+			}
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(val)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets, nil
+}
+
+// InNetworks reports whether ip is inside any of nets. IPv4-mapped IPv6
+// addresses are matched against IPv4 networks.
+func InNetworks(ip net.IP, nets []*net.IPNet) bool {
+	if ip == nil {
+		return false
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	for _, ipnet := range nets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// OfflineUUID returns the UUID of player name used by offline mode servers.
+func OfflineUUID(name string) (uuid string) {
+	h := md5.Sum([]byte("OfflinePlayer:" + name))
+	h[6] &= 0x0F
+	h[6] |= 0x30
+	h[8] &= 0x3F
+	h[8] |= 0x80
+	return mcproto.FormatUUID(h[:])
+}
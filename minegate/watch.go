@@ -0,0 +1,46 @@
+package minegate
+
+import (
+	"fmt"
+	log "github.com/jackyyf/golog"
+	"os"
+	"sync"
+	"time"
+)
+
+func fileStamp(path string) (stamp string) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%d:%d", info.ModTime().UnixNano(), info.Size())
+}
+
+// WatchFile polls path every interval, and calls reload when it's modified.
+// Call the returned function to stop watching.
+func WatchFile(path string, interval time.Duration, reload func()) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		last := fileStamp(path)
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(interval):
+			}
+			cur := fileStamp(path)
+			if cur == last {
+				continue
+			}
+			last = cur
+			log.Infof("%s changed, reloading.", path)
+			reload()
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+		})
+	}
+}
@@ -0,0 +1,153 @@
+package aggregate
+
+import (
+	"github.com/jackyyf/MineGate-Go/mcproto"
+	"github.com/jackyyf/MineGate-Go/minegate"
+	log "github.com/jackyyf/golog"
+	"time"
+)
+
+// Status of an upstream with aggregate setting includes players of other
+// upstreams (by name), which are pinged in parallel, and those not answering
+// in timeout seconds are left out.
+//
+//   aggregate:
+//     upstreams: [lobby, survival, creative]
+//     version: 'MyNetwork 1.8-1.20'
+//     sample: 12
+//     timeout: 2
+//
+// A list of upstream names is also accepted. Upstreams are pinged with
+// handshake of client, rewritten by their own settings. If the upstream with
+// aggregate itself is unavailable, players of others are still shown, with
+// its error message.
+
+const default_sample = 12
+const default_timeout = 2
+
+type options struct {
+	upstreams []string
+	version   string
+	sample    int
+	timeout   time.Duration
+}
+
+// Options of upstreams, nil if they have none.
+var settings = minegate.NewUpstreamSettings(func(upstream *minegate.Upstream) interface{} {
+	val, err := upstream.GetExtra("aggregate")
+	if err != nil || val == nil {
+		return (*options)(nil)
+	}
+	return parseOptions(val)
+})
+
+func init() {
+	minegate.OnPostLoadConfig(loadConfig, 0)
+	minegate.OnPreStatusResponse(aggregateStatus, 10)
+}
+
+func loadConfig() {
+	settings.Load()
+}
+
+func parseOptions(val interface{}) (opts *options) {
+	opts = &options{
+		sample:  default_sample,
+		timeout: default_timeout * time.Second,
+	}
+	var names interface{} = val
+	if conf, ok := val.(map[interface{}]interface{}); ok {
+		names = conf["upstreams"]
+		opts.version = minegate.ToString(conf["version"])
+		if sample, ok := conf["sample"]; ok {
+			opts.sample = int(minegate.ToInt(sample))
+		}
+		if timeout := minegate.ToUint(conf["timeout"]); timeout > 0 {
+			opts.timeout = time.Duration(timeout) * time.Second
+		}
+	}
+	switch names := names.(type) {
+	case []interface{}:
+		for _, name := range names {
+			opts.upstreams = append(opts.upstreams, minegate.ToString(name))
+		}
+	case string:
+		opts.upstreams = []string{names}
+	}
+	return
+}
+
+type result struct {
+	name string
+	resp *mcproto.MCStatusResponse
+	err  error
+}
+
+func aggregateStatus(psre *minegate.PreStatusResponseEvent) {
+	opts := settings.Get(psre.Upstream).(*options)
+	if opts == nil || psre.InitPacket == nil {
+		return
+	}
+	// Pings may outlive this handler if they time out.
+	handshake := *psre.InitPacket
+	results := make(chan result, len(opts.upstreams))
+	pending := 0
+	for _, name := range opts.upstreams {
+		upstream := minegate.FindUpstream(name)
+		if upstream == nil {
+			log.Warnf("[aggregate] no upstream named %s", name)
+			continue
+		}
+		pending++
+		go func(name string, upstream *minegate.Upstream) {
+			resp, err := minegate.FetchStatus(psre.GetConnID(), upstream, &handshake)
+			results <- result{name, resp, err}
+		}(name, upstream)
+	}
+	var collected []*mcproto.MCStatusResponse
+	timeout := time.After(opts.timeout)
+collect:
+	for ; pending > 0; pending-- {
+		var res result
+		select {
+		case res = <-results:
+		case <-timeout:
+			psre.Warnf("[aggregate] %d upstream(s) timed out, status is partial.", pending)
+			break collect
+		}
+		if res.err != nil {
+			psre.Warnf("[aggregate] unable to get status of %s: %s", res.name, res.err.Error())
+			continue
+		}
+		collected = append(collected, res.resp)
+	}
+	if psre.Err != nil && len(collected) > 0 && opts.version == "" {
+		// Not the version of minegate, so clients can join.
+		psre.Packet.Version = collected[0].Version
+	}
+	merge(psre.Packet, collected, opts)
+}
+
+// merge adds players of others to resp, samples are deduplicated by name.
+func merge(resp *mcproto.MCStatusResponse, others []*mcproto.MCStatusResponse, opts *options) {
+	seen := make(map[string]bool)
+	for _, player := range resp.Players.Sample {
+		seen[player.Name] = true
+	}
+	for _, other := range others {
+		resp.Players.Online += other.Players.Online
+		resp.Players.Max += other.Players.Max
+		for _, player := range other.Players.Sample {
+			if !seen[player.Name] {
+				seen[player.Name] = true
+				resp.Players.Sample = append(resp.Players.Sample, player)
+			}
+		}
+	}
+	if opts.sample >= 0 && len(resp.Players.Sample) > opts.sample {
+		resp.Players.Sample = resp.Players.Sample[:opts.sample]
+	}
+	if opts.version != "" {
+		resp.Version.Name = opts.version
+	}
+}
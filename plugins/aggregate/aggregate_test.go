@@ -0,0 +1,126 @@
+package aggregate
+
+import (
+	"errors"
+	"github.com/jackyyf/MineGate-Go/mcchat"
+	"github.com/jackyyf/MineGate-Go/mcproto"
+	"github.com/jackyyf/MineGate-Go/minegate"
+	log "github.com/jackyyf/golog"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func status(online, max int, names ...string) (resp *mcproto.MCStatusResponse) {
+	resp = new(mcproto.MCStatusResponse)
+	resp.Version.Name = "1.8"
+	resp.Players.Online, resp.Players.Max = online, max
+	for _, name := range names {
+		resp.Players.Sample = append(resp.Players.Sample, mcproto.StatusPlayer{Name: name})
+	}
+	return
+}
+
+func TestMerge(t *testing.T) {
+	defer func() {
+		if r := recover(); r != nil {
+			t.Fatalf("Recovered from panic: %s", r)
+			return
+		}
+	}()
+	cases := []struct {
+		conf    interface{}
+		others  []*mcproto.MCStatusResponse
+		online  int
+		max     int
+		sample  []string
+		version string
+	}{
+		{[]interface{}{"a"}, nil, 2, 20, []string{"Notch", "Jeb_"}, "1.8"},
+		{[]interface{}{"a", "b"},
+			[]*mcproto.MCStatusResponse{status(3, 50, "Steve", "Notch"), status(1, 10, "Alex")},
+			6, 80, []string{"Notch", "Jeb_", "Steve", "Alex"}, "1.8"},
+		{map[interface{}]interface{}{"upstreams": "a", "sample": 3, "version": "Network"},
+			[]*mcproto.MCStatusResponse{status(3, 50, "Steve", "Alex")},
+			5, 70, []string{"Notch", "Jeb_", "Steve"}, "Network"},
+		{map[interface{}]interface{}{"upstreams": "a", "sample": 0},
+			[]*mcproto.MCStatusResponse{status(3, 50, "Steve")},
+			5, 70, []string{}, "1.8"},
+	}
+	for idx, c := range cases {
+		resp := status(2, 20, "Notch", "Jeb_")
+		merge(resp, c.others, parseOptions(c.conf))
+		if resp.Players.Online != c.online || resp.Players.Max != c.max || resp.Version.Name != c.version {
+			t.Errorf("Case %d: %d/%d %s found, %d/%d %s expected", idx, resp.Players.Online, resp.Players.Max,
+				resp.Version.Name, c.online, c.max, c.version)
+		}
+		if len(resp.Players.Sample) != len(c.sample) {
+			t.Errorf("Case %d: sample %+v found, %v expected", idx, resp.Players.Sample, c.sample)
+			continue
+		}
+		for i, name := range c.sample {
+			if resp.Players.Sample[i].Name != name {
+				t.Errorf("Case %d: sample %+v found, %v expected", idx, resp.Players.Sample, c.sample)
+				break
+			}
+		}
+	}
+	if !t.Failed() {
+		t.Log("Ok, status merged.")
+	}
+}
+
+func TestUnavailable(t *testing.T) {
+	defer func() {
+		if r := recover(); r != nil {
+			t.Fatalf("Recovered from panic: %s", r)
+			return
+		}
+	}()
+	defer os.Remove("aggregate.yml")
+	log.SetLogLevel(log.FATAL)
+	if err := ioutil.WriteFile("aggregate.yml", []byte(
+		`
+listen: ':25565'
+upstreams:
+- name: survival
+  hostname: survival.example.com
+  upstream: 127.0.0.1:25501
+  status:
+    version: Survival
+    protocol: 47
+    max_players: 20
+    online: 5
+- hostname: hub.example.com
+  upstream: 127.0.0.1:25502
+  aggregate: [survival]`), 0644); err != nil {
+		t.Fatal("Unable to write to aggregate.yml")
+		return
+	}
+	minegate.SetConfig("aggregate.yml")
+	minegate.ConfReload()
+	hub, _ := minegate.MatchUpstream("hub.example.com")
+	if hub == nil {
+		t.Fatal("No upstream found for hub.example.com")
+		return
+	}
+	psre := new(minegate.PreStatusResponseEvent)
+	psre.InitPacket = &mcproto.MCHandShake{Proto: 47, ServerAddr: "hub.example.com", ServerPort: 25565, NextState: 1}
+	psre.Packet = new(mcproto.MCStatusResponse)
+	psre.Packet.Version.Name = "minegate"
+	psre.Packet.Description = mcchat.NewMsg("Hub is offline.")
+	psre.Upstream = hub
+	psre.Err = errors.New("connection refused")
+	aggregateStatus(psre)
+	resp := psre.Packet
+	if resp.Players.Online != 5 || resp.Players.Max != 20 || resp.Version.Name != "Survival" {
+		t.Errorf("Players of survival should be shown, %d/%d %s found", resp.Players.Online, resp.Players.Max,
+			resp.Version.Name)
+	}
+	if resp.Description.Text != "Hub is offline." {
+		t.Errorf("Error message of hub should be kept, %s found", resp.Description.Text)
+	}
+	if !t.Failed() {
+		t.Log("Ok, status aggregated without the upstream itself.")
+	}
+}
@@ -0,0 +1,398 @@
+package ban
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jackyyf/MineGate-Go/minegate"
+	log "github.com/jackyyf/golog"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Bans by player name, UUID, IP or CIDR network, kept in a JSON file which
+// survives restarts. Banned players are kicked on login, with reason and
+// remaining time. With drop, connections from banned addresses are closed
+// right after accepted instead.
+//
+//   bans:
+//     file: bans.json
+//     drop: false
+//     message: "You are banned.\nReason: {reason}\nExpires in: {remaining}"
+//     permanent_message: "You are banned permanently.\nReason: {reason}"
+//
+// {reason}, {by}, {remaining} and {expires} are replaced in messages. Other
+// plugins may manage bans with Add, Remove and List.
+//
+// UUID sent by client on login is not verified, so UUID bans also match the
+// offline UUID of player name. A client sending another UUID evades bans of
+// online UUIDs, ban names as well to be safe.
+
+const (
+	KindName = "name"
+	KindUUID = "uuid"
+	KindIP   = "ip"
+	KindCIDR = "cidr"
+)
+
+const default_file = "bans.json"
+const default_message = "You are banned from this server.\nReason: {reason}\nExpires in: {remaining}"
+const default_permanent_message = "You are permanently banned from this server.\nReason: {reason}"
+const default_reason = "Banned by an operator."
+
+type Ban struct {
+	Kind    string    `json:"type"`
+	Target  string    `json:"target"`
+	Reason  string    `json:"reason"`
+	Issuer  string    `json:"by"`
+	Created time.Time `json:"created"`
+	// Zero means permanent.
+	Expires time.Time `json:"expires,omitempty"`
+	network *net.IPNet
+}
+
+var lock sync.Mutex
+var bans = make(map[string]*Ban)
+var ban_file string
+var drop bool
+var message = default_message
+var permanent_message = default_permanent_message
+
+func init() {
+	minegate.OnPostLoadConfig(loadConfig, 0)
+	minegate.OnPostAccept(checkAccept, 3)
+	minegate.OnLoginRequest(checkLogin, 3)
+}
+
+func normalizeUUID(uuid string) (res string, ok bool) {
+	res = strings.ToLower(strings.Replace(strings.TrimSpace(uuid), "-", "", -1))
+	if len(res) != 32 {
+		return "", false
+	}
+	if _, err := hex.DecodeString(res); err != nil {
+		return "", false
+	}
+	return res, true
+}
+
+// normalize validates ban, and returns its key.
+func (ban *Ban) normalize() (key string, err error) {
+	ban.Kind = strings.ToLower(strings.TrimSpace(ban.Kind))
+	ban.Target = strings.TrimSpace(ban.Target)
+	switch ban.Kind {
+	case KindName:
+		ban.Target = strings.ToLower(ban.Target)
+		if ban.Target == "" {
+			return "", errors.New("empty player name")
+		}
+	case KindUUID:
+		var ok bool
+		if ban.Target, ok = normalizeUUID(ban.Target); !ok {
+			return "", errors.New("invalid uuid " + ban.Target)
+		}
+	case KindIP, KindCIDR:
+		if (ban.Kind == KindCIDR) != strings.Contains(ban.Target, "/") {
+			return "", fmt.Errorf("invalid %s %s", ban.Kind, ban.Target)
+		}
+		nets, err := minegate.ParseCIDRList([]string{ban.Target})
+		if err != nil {
+			return "", err
+		}
+		ban.network = nets[0]
+		ban.Target = ban.network.String()
+		if ban.Kind == KindIP {
+			ban.Target = ban.network.IP.String()
+		}
+	default:
+		return "", errors.New("invalid ban type " + ban.Kind)
+	}
+	if ban.Reason == "" {
+		ban.Reason = default_reason
+	}
+	return ban.Kind + ":" + ban.Target, nil
+}
+
+func (ban *Ban) Permanent() bool {
+	return ban.Expires.IsZero()
+}
+
+func (ban *Ban) Expired(now time.Time) bool {
+	return !ban.Permanent() && !now.Before(ban.Expires)
+}
+
+// Remaining formats time left like 2d 3h 5m.
+func (ban *Ban) Remaining(now time.Time) string {
+	if ban.Permanent() {
+		return "never"
+	}
+	left := ban.Expires.Sub(now)
+	if left < time.Minute {
+		return fmt.Sprintf("%ds", int(left.Seconds()+0.999))
+	}
+	minutes := int(left.Minutes() + 0.999)
+	days, hours := minutes/1440, minutes/60%24
+	minutes %= 60
+	res := ""
+	if days > 0 {
+		res += fmt.Sprintf("%dd ", days)
+	}
+	if days > 0 || hours > 0 {
+		res += fmt.Sprintf("%dh ", hours)
+	}
+	return res + fmt.Sprintf("%dm", minutes)
+}
+
+// Message formats kick message of ban.
+func (ban *Ban) Message(now time.Time) string {
+	lock.Lock()
+	text := message
+	if ban.Permanent() {
+		text = permanent_message
+	}
+	lock.Unlock()
+	expires := "never"
+	if !ban.Permanent() {
+		expires = ban.Expires.Local().Format("2006-01-02 15:04")
+	}
+	return strings.NewReplacer(
+		"{reason}", ban.Reason,
+		"{by}", ban.Issuer,
+		"{remaining}", ban.Remaining(now),
+		"{expires}", expires,
+	).Replace(text)
+}
+
+// Must be called with lock held.
+func save() error {
+	if ban_file == "" {
+		return nil
+	}
+	list := make([]*Ban, 0, len(bans))
+	for _, ban := range bans {
+		list = append(list, ban)
+	}
+	sort.Sort(byCreated(list))
+	content, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Replace the file at once, so it's never half written.
+	tmp := ban_file + ".tmp"
+	if err = ioutil.WriteFile(tmp, content, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, ban_file)
+}
+
+// Must be called with lock held.
+func load() {
+	loaded := make(map[string]*Ban)
+	content, err := ioutil.ReadFile(ban_file)
+	if os.IsNotExist(err) {
+		bans = loaded
+		return
+	}
+	if err != nil {
+		log.Errorf("[ban] unable to load %s: %s", ban_file, err.Error())
+		return
+	}
+	var list []*Ban
+	if err = json.Unmarshal(content, &list); err != nil {
+		log.Errorf("[ban] error when parsing %s: %s", ban_file, err.Error())
+		return
+	}
+	now := time.Now()
+	for _, ban := range list {
+		key, err := ban.normalize()
+		if err != nil {
+			log.Errorf("[ban] invalid ban in %s: %s", ban_file, err.Error())
+			continue
+		}
+		if !ban.Expired(now) {
+			loaded[key] = ban
+		}
+	}
+	bans = loaded
+	log.Infof("[ban] %d ban(s) loaded from %s", len(bans), ban_file)
+}
+
+func loadConfig() {
+	file := default_file
+	if val, err := minegate.GetExtraConf("bans.file"); err == nil {
+		file = minegate.ToString(val)
+	}
+	file, _ = filepath.Abs(file)
+	lock.Lock()
+	defer lock.Unlock()
+	drop = false
+	if val, err := minegate.GetExtraConf("bans.drop"); err == nil {
+		drop = minegate.ToBool(val)
+	}
+	message, permanent_message = default_message, default_permanent_message
+	if val, err := minegate.GetExtraConf("bans.message"); err == nil {
+		message = minegate.ToString(val)
+	}
+	if val, err := minegate.GetExtraConf("bans.permanent_message"); err == nil {
+		permanent_message = minegate.ToString(val)
+	}
+	ban_file = file
+	load()
+}
+
+// Add adds (or replaces) a ban, which is saved to file at once. Created is
+// set to now if zero.
+func Add(ban *Ban) (err error) {
+	b := *ban
+	key, err := b.normalize()
+	if err != nil {
+		return err
+	}
+	if b.Created.IsZero() {
+		b.Created = time.Now()
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	bans[key] = &b
+	log.Infof("[ban] %s %s banned by %s: %s", b.Kind, b.Target, b.Issuer, b.Reason)
+	return save()
+}
+
+// Remove lifts ban of target (name, uuid, ip or cidr).
+func Remove(kind, target string) (removed bool, err error) {
+	key, err := (&Ban{Kind: kind, Target: target}).normalize()
+	if err != nil {
+		return false, err
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if _, removed = bans[key]; !removed {
+		return false, nil
+	}
+	delete(bans, key)
+	log.Infof("[ban] %s lifted", key)
+	return true, save()
+}
+
+type byCreated []*Ban
+
+func (list byCreated) Len() int {
+	return len(list)
+}
+
+func (list byCreated) Swap(i, j int) {
+	list[i], list[j] = list[j], list[i]
+}
+
+func (list byCreated) Less(i, j int) bool {
+	return list[i].Created.Before(list[j].Created)
+}
+
+// List returns copies of bans in effect, oldest first.
+func List() (list []Ban) {
+	now := time.Now()
+	lock.Lock()
+	sorted := make([]*Ban, 0, len(bans))
+	for _, ban := range bans {
+		if !ban.Expired(now) {
+			sorted = append(sorted, ban)
+		}
+	}
+	lock.Unlock()
+	sort.Sort(byCreated(sorted))
+	list = make([]Ban, 0, len(sorted))
+	for _, ban := range sorted {
+		list = append(list, *ban)
+	}
+	return
+}
+
+// Find returns the ban in effect for player (name and uuid may be empty) from
+// ip, nil if not banned. Expired bans are removed.
+func Find(name, uuid string, ip net.IP) (ban *Ban) {
+	now := time.Now()
+	lock.Lock()
+	defer lock.Unlock()
+	expired := false
+	var found *Ban
+	check := func(b *Ban, key string) bool {
+		if b == nil {
+			return false
+		}
+		if b.Expired(now) {
+			delete(bans, key)
+			expired = true
+			return false
+		}
+		found = b
+		return true
+	}
+	if name != "" {
+		key := KindName + ":" + strings.ToLower(name)
+		check(bans[key], key)
+	}
+	if uuid, ok := normalizeUUID(uuid); found == nil && ok {
+		key := KindUUID + ":" + uuid
+		check(bans[key], key)
+	}
+	if found == nil && ip != nil {
+		for key, b := range bans {
+			if b.network != nil && minegate.InNetworks(ip, []*net.IPNet{b.network}) && check(b, key) {
+				break
+			}
+		}
+	}
+	if expired {
+		if err := save(); err != nil {
+			log.Errorf("[ban] unable to save %s: %s", ban_file, err.Error())
+		}
+	}
+	if found == nil {
+		return nil
+	}
+	res := *found
+	return &res
+}
+
+func checkAccept(pae *minegate.PostAcceptEvent) {
+	lock.Lock()
+	enabled := drop
+	lock.Unlock()
+	if !enabled || pae.Rejected() {
+		return
+	}
+	if ban := Find("", "", pae.RemoteAddr.IP); ban != nil {
+		pae.Warnf("[ban] connection from banned %s %s dropped.", ban.Kind, ban.Target)
+		pae.Reject()
+	}
+}
+
+// findLogin finds ban of a player logging in. UUID sent by client is not
+// verified, so offline UUID of name is always checked as well.
+func findLogin(name, uuid string, ip net.IP) *Ban {
+	if ban := Find(name, uuid, ip); ban != nil {
+		return ban
+	}
+	if offline := minegate.OfflineUUID(name); offline != uuid {
+		return Find("", offline, nil)
+	}
+	return nil
+}
+
+func checkLogin(lre *minegate.LoginRequestEvent) {
+	if lre.Rejected() {
+		return
+	}
+	name := lre.LoginPacket.Name
+	uuid, _ := lre.LoginPacket.PlayerUUID()
+	if ban := findLogin(name, uuid, lre.RemoteAddr.IP); ban != nil {
+		lre.Warnf("[ban] %s is banned (%s %s): %s", name, ban.Kind, ban.Target, ban.Reason)
+		lre.Reason(ban.Message(time.Now()))
+	}
+}
@@ -0,0 +1,233 @@
+package ban
+
+import (
+	"github.com/jackyyf/MineGate-Go/minegate"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNormalize(t *testing.T) {
+	defer func() {
+		if r := recover(); r != nil {
+			t.Fatalf("Recovered from panic: %s", r)
+			return
+		}
+	}()
+	cases := []struct {
+		kind   string
+		target string
+		key    string
+	}{
+		{"name", " Notch ", "name:notch"},
+		{"UUID", "069A79F4-44E9-4726-A5BE-FCA90E38AAF5", "uuid:069a79f444e94726a5befca90e38aaf5"},
+		{"uuid", "069a79f4", ""},
+		{"uuid", "zz9a79f444e94726a5befca90e38aaf5", ""},
+		{"ip", "198.51.100.7", "ip:198.51.100.7"},
+		{"ip", "198.51.100.0/24", ""},
+		{"cidr", "198.51.100.7/24", "cidr:198.51.100.0/24"},
+		{"cidr", "198.51.100.7", ""},
+		{"cidr", "2001:db8::1/32", "cidr:2001:db8::/32"},
+		{"name", "", ""},
+		{"player", "Notch", ""},
+	}
+	for idx, c := range cases {
+		ban := &Ban{Kind: c.kind, Target: c.target}
+		key, err := ban.normalize()
+		if c.key == "" {
+			if err == nil {
+				t.Errorf("Case %d: %s %s accepted as %s, error expected", idx, c.kind, c.target, key)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Case %d: %s %s rejected: %s", idx, c.kind, c.target, err.Error())
+		} else if key != c.key || ban.Reason != default_reason {
+			t.Errorf("Case %d: key %s, reason %q found, %s expected", idx, key, ban.Reason, c.key)
+		}
+	}
+	t.Log("Ok, bans are normalized.")
+}
+
+func TestRemaining(t *testing.T) {
+	now := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	cases := []struct {
+		left      time.Duration
+		remaining string
+	}{
+		{0, "never"},
+		{time.Second, "1s"},
+		{1500 * time.Millisecond, "2s"},
+		{59 * time.Second, "59s"},
+		{time.Minute, "1m"},
+		{61 * time.Second, "2m"},
+		{time.Hour, "1h 0m"},
+		{26*time.Hour + 5*time.Minute, "1d 2h 5m"},
+		{48 * time.Hour, "2d 0h 0m"},
+	}
+	for idx, c := range cases {
+		ban := &Ban{}
+		if c.left != 0 {
+			ban.Expires = now.Add(c.left)
+		}
+		if remaining := ban.Remaining(now); remaining != c.remaining {
+			t.Errorf("Case %d: %s found, %s expected", idx, remaining, c.remaining)
+		}
+	}
+	t.Log("Ok, remaining time is formatted.")
+}
+
+func TestFind(t *testing.T) {
+	defer func() {
+		if r := recover(); r != nil {
+			t.Fatalf("Recovered from panic: %s", r)
+			return
+		}
+	}()
+	now := time.Now()
+	lock.Lock()
+	ban_file = ""
+	bans = make(map[string]*Ban)
+	lock.Unlock()
+	defer func() {
+		lock.Lock()
+		bans = make(map[string]*Ban)
+		lock.Unlock()
+	}()
+	uuid := "069a79f4-44e9-4726-a5be-fca90e38aaf5"
+	for _, ban := range []*Ban{
+		{Kind: KindName, Target: "Griefer", Reason: "griefing"},
+		{Kind: KindUUID, Target: uuid, Expires: now.Add(time.Hour)},
+		{Kind: KindName, Target: "Expired", Expires: now.Add(-time.Second)},
+		{Kind: KindCIDR, Target: "203.0.113.0/24", Expires: now.Add(-time.Second)},
+		{Kind: KindIP, Target: "198.51.100.7"},
+	} {
+		if err := Add(ban); err != nil {
+			t.Fatalf("Unable to add ban %+v: %s", ban, err.Error())
+		}
+	}
+	cases := []struct {
+		name   string
+		uuid   string
+		ip     string
+		target string
+	}{
+		{"griefer", "", "192.0.2.1", "griefer"},
+		{"Notch", uuid, "192.0.2.1", "069a79f444e94726a5befca90e38aaf5"},
+		{"Expired", "", "192.0.2.1", ""},
+		{"Steve", "", "203.0.113.5", ""},
+		{"Steve", "", "::ffff:198.51.100.7", "198.51.100.7"},
+		{"", "", "198.51.100.8", ""},
+	}
+	for idx, c := range cases {
+		ban := Find(c.name, c.uuid, net.ParseIP(c.ip))
+		if c.target == "" {
+			if ban != nil {
+				t.Errorf("Case %d: %s found, not banned expected", idx, ban.Target)
+			}
+		} else if ban == nil || ban.Target != c.target {
+			t.Errorf("Case %d: %+v found, %s expected", idx, ban, c.target)
+		}
+	}
+	lock.Lock()
+	count := len(bans)
+	lock.Unlock()
+	if count != 3 || len(List()) != 3 {
+		t.Errorf("%d bans left, expired bans should be removed", count)
+	}
+	t.Log("Ok, bans found, expired ones removed.")
+}
+
+func TestSaveLoad(t *testing.T) {
+	defer func() {
+		if r := recover(); r != nil {
+			t.Fatalf("Recovered from panic: %s", r)
+			return
+		}
+	}()
+	dir, err := ioutil.TempDir("", "ban")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	lock.Lock()
+	ban_file = filepath.Join(dir, "bans.json")
+	bans = make(map[string]*Ban)
+	lock.Unlock()
+	defer func() {
+		lock.Lock()
+		ban_file = ""
+		bans = make(map[string]*Ban)
+		lock.Unlock()
+	}()
+	expires := time.Now().Add(time.Hour).Round(time.Second)
+	added := []*Ban{
+		{Kind: KindName, Target: "Griefer", Reason: "griefing", Issuer: "Notch", Created: expires.Add(-2 * time.Hour)},
+		{Kind: KindCIDR, Target: "203.0.113.0/24", Created: expires.Add(-time.Hour), Expires: expires},
+	}
+	for _, ban := range added {
+		if err := Add(ban); err != nil {
+			t.Fatalf("Unable to add ban %+v: %s", ban, err.Error())
+		}
+	}
+	lock.Lock()
+	bans = make(map[string]*Ban)
+	load()
+	lock.Unlock()
+	list := List()
+	if len(list) != 2 {
+		t.Fatalf("%d bans loaded, 2 expected", len(list))
+	}
+	if list[0].Target != "griefer" || list[0].Reason != "griefing" || list[0].Issuer != "Notch" ||
+		!list[0].Permanent() {
+		t.Errorf("Ban %+v loaded", list[0])
+	}
+	if list[1].Target != "203.0.113.0/24" || !list[1].Expires.Equal(expires) {
+		t.Errorf("Ban %+v loaded", list[1])
+	}
+	if ban := Find("", "", net.ParseIP("203.0.113.9")); ban == nil {
+		t.Error("Loaded network ban not found")
+	}
+	t.Log("Ok, bans saved and loaded.")
+}
+
+func TestFindLogin(t *testing.T) {
+	defer func() {
+		if r := recover(); r != nil {
+			t.Fatalf("Recovered from panic: %s", r)
+			return
+		}
+	}()
+	lock.Lock()
+	ban_file = ""
+	bans = make(map[string]*Ban)
+	lock.Unlock()
+	defer func() {
+		lock.Lock()
+		bans = make(map[string]*Ban)
+		lock.Unlock()
+	}()
+	if err := Add(&Ban{Kind: KindUUID, Target: minegate.OfflineUUID("Alex")}); err != nil {
+		t.Fatalf("Unable to add ban: %s", err.Error())
+	}
+	spoofed := "069a79f4-44e9-4726-a5be-fca90e38aaf5"
+	cases := []struct {
+		name   string
+		uuid   string
+		banned bool
+	}{
+		{"Alex", "", true},
+		{"Alex", spoofed, true},
+		{"Steve", spoofed, false},
+		{"Steve", minegate.OfflineUUID("Alex"), true},
+	}
+	for idx, c := range cases {
+		if ban := findLogin(c.name, c.uuid, net.ParseIP("192.0.2.1")); (ban != nil) != c.banned {
+			t.Errorf("Case %d: %s with %q, banned %v expected", idx, c.name, c.uuid, c.banned)
+		}
+	}
+	t.Log("Ok, offline UUID checked along with UUID sent.")
+}
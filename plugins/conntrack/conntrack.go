@@ -6,13 +6,10 @@ import (
 	log "github.com/jackyyf/golog"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-var brust uint64 = 5
-var limit uint64 = 5
-var delta uint64 = 60
-
 var ollock sync.Mutex
 
 type loginInfo struct {
@@ -26,96 +23,146 @@ var conn_in = make(map[uint64]loginInfo)
 // Track online user for each server.
 var online_list = make(map[string]mapset.Set)
 
-// Track connection per ip
-var ctlock sync.Mutex
-var conn_track = make(map[string]uint64)
+// Connections are rate limited with token buckets per IP and per network
+// prefix (/24 for IPv4 and /64 for IPv6 by default). All accepted connections
+// take from the connect budget, and are closed at once when it runs out.
+// Pings and logins have separate budgets, checked once handshake is read.
+// Each budget refills limit tokens per interval seconds, up to limit + brust.
+// Prefix budgets are off unless prefix_factor or prefix_limit is set, and are
+// prefix_factor (4 by default) times of those of single IPs unless set. At
+// most max_entries buckets are kept, least recently used ones are dropped.
+//
+//   conntrack:
+//     interval: 60
+//     limit: 5
+//     brust: 5
+//     connect:
+//       limit: 10
+//       brust: 10
+//     login:
+//       limit: 3
+//       brust: 2
+//     ping:
+//       limit: 30
+//       brust: 10
+//       prefix_limit: 120
+//       prefix_brust: 40
+//     ipv4_prefix: 24
+//     ipv6_prefix: 64
+//     prefix_factor: 4
+//     max_entries: 65536
+//
+// limit and brust at top level are defaults of all budgets. limit 0 disables
+// the budget, including its prefix budget.
+
+const default_limit = 5
+const default_brust = 5
+const default_interval = 60
+const default_factor = 4
+const default_max_entries = 65536
+
+// Replaced as a whole on config reload, read without locks.
+var rate_limiter atomic.Value
 
 func init() {
 	minegate.OnPostLoadConfig(loadConfig, 0)
-	minegate.OnPostAccept(connectionHandler, 39)
+	minegate.OnPostAccept(connectionLimit, 39)
+	minegate.OnPreRouting(rateLimit, 39)
 	minegate.OnLoginRequest(userLogin, 39)
 	minegate.OnDisconnect(userLogout, 39)
-	go heartBeatTicker()
 }
 
-func heartBeatTicker() {
-	for {
-		time.Sleep(time.Second * time.Duration(delta))
-		if limit == 0 {
-			continue
-		}
-		ctlock.Lock()
-		log.Infof("[conntrack] Reducing connection count...")
-		for track := range conn_track {
-			if conn_track[track] <= limit {
-				delete(conn_track, track)
-				log.Debugf("[conntrack] Removing IP %s.", track)
-			} else {
-				conn_track[track] -= limit
-			}
-
-		}
-		log.Infof("[conntrack] Done. IPs currently in record: %d", len(conn_track))
-		ctlock.Unlock()
+func getUint(conf map[interface{}]interface{}, key string, def uint64) uint64 {
+	if val, ok := conf[key]; ok && val != nil {
+		return minegate.ToUint(val)
 	}
+	return def
 }
 
 func loadConfig() {
-	new_brust, err := minegate.GetExtraConf("conntrack.brust")
-	if err != nil {
-		log.Info("[conntrack] Using default brust: 5")
-		brust = 5
-	} else {
-		nb := minegate.ToUint(new_brust)
-		log.Infof("[conntrack] Using brust: %d", nb)
-		brust = nb
-	}
-	new_limit, err := minegate.GetExtraConf("conntrack.limit")
-	if err != nil {
-		log.Info("[conntrack] Using default limit: 5")
-		limit = 5
-	} else {
-		nl := minegate.ToUint(new_limit)
-		if nl != 0 {
-			log.Infof("[conntrack] Using limit: %d", nl)
-			limit = nl
-		} else {
-			log.Info("[conntrack] Limit = 0, disabling conntrack.")
-			limit = 0
+	conf := make(map[interface{}]interface{})
+	if val, err := minegate.GetExtraConf("conntrack"); err == nil {
+		if m, ok := val.(map[interface{}]interface{}); ok {
+			conf = m
 		}
 	}
-	new_delta, err := minegate.GetExtraConf("conntrack.interval")
-	if err != nil {
-		log.Info("[conntrack] Using default delta: 60")
-		delta = 60
-	} else {
-		nd := minegate.ToUint(new_delta)
-		if nd < 15 {
-			log.Warn("[conntrack] Minimal interval is 15.")
-			nd = 15
+	interval := time.Duration(getUint(conf, "interval", default_interval)) * time.Second
+	if interval <= 0 {
+		interval = default_interval * time.Second
+	}
+	limit := getUint(conf, "limit", default_limit)
+	brust := getUint(conf, "brust", default_brust)
+	factor := getUint(conf, "prefix_factor", default_factor)
+	_, has_factor := conf["prefix_factor"]
+	l := newLimiter(int(getUint(conf, "max_entries", default_max_entries)))
+	l.ipv4_prefix = int(getUint(conf, "ipv4_prefix", 24))
+	if l.ipv4_prefix > 32 {
+		l.ipv4_prefix = 32
+	}
+	l.ipv6_prefix = int(getUint(conf, "ipv6_prefix", 64))
+	if l.ipv6_prefix > 128 {
+		l.ipv6_prefix = 128
+	}
+	for kind, name := range []string{"connect", "ping", "login"} {
+		sub, _ := conf[name].(map[interface{}]interface{})
+		if sub == nil {
+			sub = make(map[interface{}]interface{})
+		}
+		kind_limit := getUint(sub, "limit", limit)
+		kind_brust := getUint(sub, "brust", brust)
+		if kind_limit == 0 {
+			// Prefix budget is disabled too, even if set.
+			log.Infof("[conntrack] %s rate limiting disabled.", name)
+			continue
 		}
-		log.Infof("[conntrack] Using interval %d", nd)
-		delta = nd
+		l.ip[kind] = newBudget(kind_limit, kind_brust, interval)
+		if _, ok := sub["prefix_limit"]; !ok && !has_factor {
+			log.Infof("[conntrack] %s: %d+%d per address, every %s.", name, kind_limit, kind_brust, interval)
+			continue
+		}
+		prefix_limit := getUint(sub, "prefix_limit", kind_limit*factor)
+		prefix_brust := getUint(sub, "prefix_brust", kind_brust*factor)
+		l.prefix[kind] = newBudget(prefix_limit, prefix_brust, interval)
+		log.Infof("[conntrack] %s: %d+%d per address, %d+%d per prefix, every %s.",
+			name, kind_limit, kind_brust, prefix_limit, prefix_brust, interval)
 	}
+	rate_limiter.Store(l)
 }
 
-func connectionHandler(event *minegate.PostAcceptEvent) {
+func connectionLimit(event *minegate.PostAcceptEvent) {
 	if event.Rejected() {
 		return
 	}
-	ip := event.RemoteAddr.IP.String()
-	if limit == 0 {
+	l, _ := rate_limiter.Load().(*limiter)
+	if l == nil {
 		return
 	}
-	ctlock.Lock()
-	defer ctlock.Unlock()
-	if conn_track[ip] >= brust+limit {
-		event.Warnf("[conntrack] Rejected: reach connection limit.")
+	if ok, reason := l.allow(event.RemoteAddr.IP, kindConnect); !ok {
+		event.Warnf("[conntrack] Rejected: connection rate limit of %s reached.", reason)
 		event.Reject()
+	}
+}
+
+func rateLimit(event *minegate.PreRoutingEvent) {
+	if event.Rejected() {
 		return
 	}
-	conn_track[ip] += 1
-	event.Infof("[conntrack] Accepted: connection count = %d", conn_track[ip])
+	l, _ := rate_limiter.Load().(*limiter)
+	if l == nil {
+		return
+	}
+	kind := kindLogin
+	if event.Packet.NextState == 1 {
+		kind = kindPing
+	}
+	if ok, reason := l.allow(event.RemoteAddr.IP, kind); !ok {
+		if kind == kindPing {
+			event.Warnf("[conntrack] Rejected: ping rate limit of %s reached.", reason)
+		} else {
+			event.Warnf("[conntrack] Rejected: login rate limit of %s reached.", reason)
+		}
+		event.Reason("Too many connections, please try again later.")
+	}
 }
 
 func userLogin(event *minegate.LoginRequestEvent) {
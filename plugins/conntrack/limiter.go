@@ -0,0 +1,150 @@
+package conntrack
+
+import (
+	"container/list"
+	"hash/fnv"
+	"net"
+	"sync"
+	"time"
+)
+
+// Budget refills limit tokens per interval, up to limit + brust. Zero limit
+// means unlimited.
+type budget struct {
+	rate     float64
+	capacity float64
+}
+
+type bucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+}
+
+// Buckets are kept in shards, each with its own lock and LRU list, so
+// connections from different addresses rarely wait for each other.
+const shard_count = 64
+
+type shard struct {
+	lock    sync.Mutex
+	buckets map[string]*list.Element
+	lru     *list.List
+	max     int
+}
+
+const (
+	kindConnect = iota
+	kindPing
+	kindLogin
+	kind_count
+)
+
+type limiter struct {
+	// By kind, for single IPs and aggregated prefixes.
+	ip          [kind_count]budget
+	prefix      [kind_count]budget
+	ipv4_prefix int
+	ipv6_prefix int
+	shards      [shard_count]*shard
+}
+
+func newBudget(limit, brust uint64, interval time.Duration) budget {
+	if limit == 0 {
+		return budget{}
+	}
+	return budget{
+		rate:     float64(limit) / interval.Seconds(),
+		capacity: float64(limit + brust),
+	}
+}
+
+func newLimiter(max_entries int) (l *limiter) {
+	l = new(limiter)
+	per_shard := max_entries / shard_count
+	if per_shard < 1 {
+		per_shard = 1
+	}
+	for idx := range l.shards {
+		l.shards[idx] = &shard{
+			buckets: make(map[string]*list.Element),
+			lru:     list.New(),
+			max:     per_shard,
+		}
+	}
+	return
+}
+
+func (l *limiter) shard(key string) *shard {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return l.shards[h.Sum32()%shard_count]
+}
+
+// take consumes a token of bucket key, created full if unknown. The least
+// recently used bucket is evicted when shard is full.
+func (s *shard) take(key string, b budget, now time.Time) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var bkt *bucket
+	if elem, ok := s.buckets[key]; ok {
+		s.lru.MoveToFront(elem)
+		bkt = elem.Value.(*bucket)
+		bkt.tokens += now.Sub(bkt.last).Seconds() * b.rate
+		if bkt.tokens > b.capacity {
+			bkt.tokens = b.capacity
+		}
+		bkt.last = now
+	} else {
+		if s.lru.Len() >= s.max {
+			oldest := s.lru.Back()
+			s.lru.Remove(oldest)
+			delete(s.buckets, oldest.Value.(*bucket).key)
+		}
+		bkt = &bucket{key: key, tokens: b.capacity, last: now}
+		s.buckets[key] = s.lru.PushFront(bkt)
+	}
+	if bkt.tokens < 1 {
+		return false
+	}
+	bkt.tokens--
+	return true
+}
+
+// refund gives back a token taken from bucket key.
+func (s *shard) refund(key string, b budget) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if elem, ok := s.buckets[key]; ok {
+		bkt := elem.Value.(*bucket)
+		if bkt.tokens++; bkt.tokens > b.capacity {
+			bkt.tokens = b.capacity
+		}
+	}
+}
+
+// keys returns bucket keys of ip and its prefix for kind.
+func (l *limiter) keys(ip net.IP, kind int) (ip_key, prefix_key string) {
+	bits, size := l.ipv6_prefix, 128
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits, size = ip4, l.ipv4_prefix, 32
+	}
+	tag := string([]byte{byte(kind)})
+	return tag + "i" + string(ip), tag + "p" + string(ip.Mask(net.CIDRMask(bits, size)))
+}
+
+// allow takes a token from buckets of both ip and its prefix, or none.
+func (l *limiter) allow(ip net.IP, kind int) (ok bool, reason string) {
+	ip_key, prefix_key := l.keys(ip, kind)
+	now := time.Now()
+	ip_budget, prefix_budget := l.ip[kind], l.prefix[kind]
+	if ip_budget.rate > 0 && !l.shard(ip_key).take(ip_key, ip_budget, now) {
+		return false, "address"
+	}
+	if prefix_budget.rate > 0 && !l.shard(prefix_key).take(prefix_key, prefix_budget, now) {
+		if ip_budget.rate > 0 {
+			l.shard(ip_key).refund(ip_key, ip_budget)
+		}
+		return false, "network"
+	}
+	return true, ""
+}
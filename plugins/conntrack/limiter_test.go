@@ -0,0 +1,158 @@
+package conntrack
+
+import (
+	"github.com/jackyyf/MineGate-Go/minegate"
+	log "github.com/jackyyf/golog"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestRefill(t *testing.T) {
+	defer func() {
+		if r := recover(); r != nil {
+			t.Fatalf("Recovered from panic: %s", r)
+			return
+		}
+	}()
+	b := newBudget(2, 1, 10*time.Second)
+	s := newLimiter(shard_count).shards[0]
+	now := time.Now()
+	cases := []struct {
+		after time.Duration
+		ok    bool
+	}{
+		{0, true},
+		{0, true},
+		{0, true},
+		{0, false},
+		{4 * time.Second, false},
+		{time.Second, true},
+		{0, false},
+		{time.Hour, true},
+		{0, true},
+		{0, true},
+		{0, false},
+	}
+	for idx, c := range cases {
+		now = now.Add(c.after)
+		if ok := s.take("key", b, now); ok != c.ok {
+			t.Errorf("Case %d: take=%v, %v expected", idx, ok, c.ok)
+		}
+	}
+	t.Log("Ok, buckets refill up to capacity.")
+}
+
+func TestPrefixRefund(t *testing.T) {
+	defer func() {
+		if r := recover(); r != nil {
+			t.Fatalf("Recovered from panic: %s", r)
+			return
+		}
+	}()
+	l := newLimiter(1024)
+	l.ipv4_prefix, l.ipv6_prefix = 24, 64
+	l.ip[kindLogin] = newBudget(2, 0, time.Hour)
+	l.prefix[kindLogin] = newBudget(3, 0, time.Hour)
+	cases := []struct {
+		ip     string
+		kind   int
+		ok     bool
+		reason string
+	}{
+		{"198.51.100.1", kindLogin, true, ""},
+		{"198.51.100.2", kindLogin, true, ""},
+		{"::ffff:198.51.100.3", kindLogin, true, ""},
+		// Prefix is exhausted, token of address is given back.
+		{"198.51.100.1", kindLogin, false, "network"},
+		{"198.51.101.1", kindLogin, true, ""},
+		{"198.51.101.1", kindLogin, true, ""},
+		{"198.51.101.1", kindLogin, false, "address"},
+		// Other kinds are not limited.
+		{"198.51.100.1", kindPing, true, ""},
+		{"2001:db8:0:1::1", kindLogin, true, ""},
+		{"2001:db8:0:1::2", kindLogin, true, ""},
+		{"2001:db8:0:1:ffff::1", kindLogin, true, ""},
+		{"2001:db8:0:1::1", kindLogin, false, "network"},
+		{"2001:db8:0:2::1", kindLogin, true, ""},
+	}
+	for idx, c := range cases {
+		if ok, reason := l.allow(net.ParseIP(c.ip), c.kind); ok != c.ok || reason != c.reason {
+			t.Errorf("Case %d: %s allow=%v (%s), %v (%s) expected", idx, c.ip, ok, reason, c.ok, c.reason)
+		}
+	}
+	ip_key, _ := l.keys(net.ParseIP("198.51.100.1"), kindLogin)
+	elem := l.shard(ip_key).buckets[ip_key]
+	if tokens := elem.Value.(*bucket).tokens; tokens < 0.99 || tokens > 1.01 {
+		t.Errorf("%f tokens left for 198.51.100.1, 1 expected after refund", tokens)
+	}
+	t.Log("Ok, prefix limits are applied, and rejected tokens refunded.")
+}
+
+func TestEviction(t *testing.T) {
+	defer func() {
+		if r := recover(); r != nil {
+			t.Fatalf("Recovered from panic: %s", r)
+			return
+		}
+	}()
+	b := newBudget(1, 0, time.Hour)
+	s := newLimiter(3 * shard_count).shards[0]
+	now := time.Now()
+	for _, key := range []string{"a", "b", "c"} {
+		s.take(key, b, now)
+	}
+	// a is used again, so b is the least recently used one.
+	s.take("a", b, now)
+	s.take("d", b, now)
+	if s.lru.Len() != 3 || len(s.buckets) != 3 {
+		t.Fatalf("%d buckets found, 3 expected", len(s.buckets))
+	}
+	if s.buckets["b"] != nil || s.buckets["a"] == nil {
+		t.Error("Bucket other than least recently used one evicted")
+	}
+	if !s.take("b", b, now) {
+		t.Error("Evicted bucket not recreated full")
+	}
+	if s.take("a", b, now) {
+		t.Error("Bucket a refilled")
+	}
+	t.Log("Ok, least recently used buckets are evicted.")
+}
+
+func TestPrefixConfig(t *testing.T) {
+	defer func() {
+		if r := recover(); r != nil {
+			t.Fatalf("Recovered from panic: %s", r)
+			return
+		}
+	}()
+	defer os.Remove("conntrack.yml")
+	log.SetLogLevel(log.FATAL)
+	configs := []struct {
+		conf   string
+		prefix [kind_count]bool
+	}{
+		{"limit: 10", [kind_count]bool{}},
+		{"limit: 10\n  ping:\n    prefix_limit: 40", [kind_count]bool{kindPing: true}},
+		{"limit: 10\n  prefix_factor: 2\n  login:\n    limit: 0", [kind_count]bool{kindConnect: true, kindPing: true}},
+	}
+	for idx, c := range configs {
+		if err := ioutil.WriteFile("conntrack.yml", []byte("listen: ':25565'\nconntrack:\n  "+c.conf+"\n"), 0644); err != nil {
+			t.Fatal("Unable to write to conntrack.yml")
+			return
+		}
+		minegate.SetConfig("conntrack.yml")
+		minegate.ConfReload()
+		loadConfig()
+		l := rate_limiter.Load().(*limiter)
+		for kind, enabled := range c.prefix {
+			if (l.prefix[kind].rate > 0) != enabled {
+				t.Errorf("Config %d: prefix budget %d enabled %v expected", idx, kind, enabled)
+			}
+		}
+	}
+	t.Log("Ok, prefix budgets are off unless configured.")
+}
@@ -0,0 +1,260 @@
+package geofilter
+
+import (
+	"github.com/jackyyf/MineGate-Go/minegate"
+	log "github.com/jackyyf/golog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Clients are filtered by country (looked up from the geoip database of
+// minegate) with allow and deny lists of ISO country codes, globally and per
+// upstream. With allow, only listed countries are accepted. unknown decides
+// for addresses not in the database (allowed by default).
+//
+//   geofilter:
+//     allow: [DE, FR, NL]
+//     deny: [XX]
+//     unknown: allow
+//     motd: 'Not available in your region.'
+//     kick: 'This server is not available in your region.'
+//     cache: 600
+//     drop: false
+//
+// Global filter is checked after connection is accepted: with drop, blocked
+// connections are closed at once, otherwise pings get motd and logins get
+// kick once handshake is read. Upstreams may have their own geofilter
+// (without cache and drop), checked on ping and login, messages default to
+// global ones. Lookups and decisions are cached for cache seconds, and
+// dropped when config or database is reloaded.
+
+const default_msg = "This server is not available in your region."
+const default_cache = 600
+
+// Cache is reset when it grows too large.
+const max_cache = 65536
+
+// Decisions of an address are reset when there are too many.
+const max_decisions = 64
+
+type filter struct {
+	allow   map[string]bool
+	deny    map[string]bool
+	unknown bool
+	motd    string
+	kick    string
+	drop    bool
+}
+
+type entry struct {
+	country string
+	expire  time.Time
+	// By filter.
+	decisions map[*filter]bool
+}
+
+var lock sync.Mutex
+var global *filter
+
+// Upstream filters, nil if it has none.
+var filters = minegate.NewUpstreamSettings(func(upstream *minegate.Upstream) interface{} {
+	return parseFilter(upstream.Extras["geofilter"], getGlobal())
+})
+var ttl = default_cache * time.Second
+var cache = make(map[string]*entry)
+var generation uint64
+
+func init() {
+	minegate.OnPostLoadConfig(loadConfig, 0)
+	minegate.OnPostAccept(checkAccept, 5)
+	minegate.OnPreRouting(checkRouting, 5)
+	minegate.OnPingRequest(checkPing, 5)
+	minegate.OnLoginRequest(checkLogin, 5)
+}
+
+func parseCodes(val interface{}) (codes map[string]bool) {
+	codes = make(map[string]bool)
+	switch val := val.(type) {
+	case []interface{}:
+		for _, code := range val {
+			codes[strings.ToUpper(strings.TrimSpace(minegate.ToString(code)))] = true
+		}
+	case string:
+		codes[strings.ToUpper(strings.TrimSpace(val))] = true
+	}
+	return
+}
+
+// parseFilter parses filter settings, messages default to those of base.
+func parseFilter(val interface{}, base *filter) (f *filter) {
+	conf, ok := val.(map[interface{}]interface{})
+	if !ok {
+		return nil
+	}
+	f = &filter{
+		allow:   parseCodes(conf["allow"]),
+		deny:    parseCodes(conf["deny"]),
+		unknown: true,
+		motd:    default_msg,
+		kick:    default_msg,
+	}
+	if base != nil {
+		f.motd, f.kick = base.motd, base.kick
+	}
+	if unknown, ok := conf["unknown"]; ok {
+		f.unknown = minegate.ToString(unknown) == "allow" || minegate.ToBool(unknown)
+	}
+	if motd := minegate.ToString(conf["motd"]); motd != "" {
+		f.motd = motd
+	}
+	if kick := minegate.ToString(conf["kick"]); kick != "" {
+		f.kick = kick
+	}
+	f.drop = minegate.ToBool(conf["drop"])
+	return
+}
+
+func (f *filter) allows(country string) bool {
+	if country == "" {
+		return f.unknown
+	}
+	if len(f.allow) > 0 && !f.allow[country] {
+		return false
+	}
+	return !f.deny[country]
+}
+
+func (f *filter) message(handshake_state uint64) string {
+	if handshake_state == 1 {
+		return f.motd
+	}
+	return f.kick
+}
+
+func loadConfig() {
+	val, err := minegate.GetExtraConf("geofilter")
+	var f *filter
+	if err == nil {
+		f = parseFilter(val, nil)
+	}
+	cache_ttl := time.Duration(default_cache) * time.Second
+	if val, err := minegate.GetExtraConf("geofilter.cache"); err == nil {
+		cache_ttl = time.Duration(minegate.ToUint(val)) * time.Second
+	}
+	if f != nil && !minegate.GeoIPLoaded() {
+		log.Warn("[geofilter] No geoip database loaded, all clients are unknown.")
+	}
+	lock.Lock()
+	global = f
+	ttl = cache_ttl
+	cache = make(map[string]*entry)
+	lock.Unlock()
+	filters.Load()
+}
+
+func filterOf(upstream *minegate.Upstream) *filter {
+	return filters.Get(upstream).(*filter)
+}
+
+// decide checks ip against filter f, with cached lookups and decisions.
+func decide(ip net.IP, f *filter) (allowed bool, country string) {
+	key := ip.String()
+	now := time.Now()
+	lock.Lock()
+	defer lock.Unlock()
+	if gen := minegate.GeoIPGeneration(); gen != generation {
+		generation = gen
+		cache = make(map[string]*entry)
+	}
+	e := cache[key]
+	if e == nil || now.After(e.expire) {
+		country, _ := minegate.LookupCountry(ip)
+		e = &entry{country: country, expire: now.Add(ttl), decisions: make(map[*filter]bool)}
+		if len(cache) >= max_cache {
+			for k, old := range cache {
+				if now.After(old.expire) {
+					delete(cache, k)
+				}
+			}
+			if len(cache) >= max_cache {
+				cache = make(map[string]*entry)
+			}
+		}
+		cache[key] = e
+	}
+	allowed, ok := e.decisions[f]
+	if !ok {
+		if len(e.decisions) >= max_decisions {
+			e.decisions = make(map[*filter]bool)
+		}
+		allowed = f.allows(e.country)
+		e.decisions[f] = allowed
+	}
+	return allowed, e.country
+}
+
+func getGlobal() *filter {
+	lock.Lock()
+	defer lock.Unlock()
+	return global
+}
+
+func checkAccept(pae *minegate.PostAcceptEvent) {
+	f := getGlobal()
+	if f == nil || pae.Rejected() {
+		return
+	}
+	if allowed, country := decide(pae.RemoteAddr.IP, f); !allowed {
+		if f.drop {
+			pae.Warnf("[geofilter] dropped client from %s", country)
+			pae.Reject()
+		} else {
+			pae.Infof("[geofilter] client from %s will be rejected", country)
+		}
+	}
+}
+
+func checkRouting(pre *minegate.PreRoutingEvent) {
+	f := getGlobal()
+	if f == nil || pre.Rejected() {
+		return
+	}
+	if allowed, country := decide(pre.RemoteAddr.IP, f); !allowed {
+		pre.Warnf("[geofilter] rejected client from %s", country)
+		pre.Reason(f.message(pre.Packet.NextState))
+	}
+}
+
+// checkUpstream returns rejection message of upstream filter, empty if
+// allowed.
+func checkUpstream(event *minegate.NetworkEvent, upstream *minegate.Upstream, state uint64) (reason string) {
+	f := filterOf(upstream)
+	if f == nil {
+		return ""
+	}
+	if allowed, country := decide(event.RemoteAddr.IP, f); !allowed {
+		event.Warnf("[geofilter] client from %s rejected by %s", country, upstream.Server)
+		return f.message(state)
+	}
+	return ""
+}
+
+func checkPing(pre *minegate.PingRequestEvent) {
+	if pre.Rejected() {
+		return
+	}
+	if reason := checkUpstream(&pre.NetworkEvent, pre.Upstream, 1); reason != "" {
+		pre.Reason(reason)
+	}
+}
+
+func checkLogin(lre *minegate.LoginRequestEvent) {
+	if lre.Rejected() {
+		return
+	}
+	if reason := checkUpstream(&lre.NetworkEvent, lre.Upstream, 2); reason != "" {
+		lre.Reason(reason)
+	}
+}
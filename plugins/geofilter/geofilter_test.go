@@ -0,0 +1,98 @@
+package geofilter
+
+import (
+	"github.com/jackyyf/MineGate-Go/minegate"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAllows(t *testing.T) {
+	defer func() {
+		if r := recover(); r != nil {
+			t.Fatalf("Recovered from panic: %s", r)
+			return
+		}
+	}()
+	cases := []struct {
+		conf    map[interface{}]interface{}
+		country string
+		allowed bool
+	}{
+		{map[interface{}]interface{}{"allow": []interface{}{"de", "FR"}}, "DE", true},
+		{map[interface{}]interface{}{"allow": []interface{}{"de", "FR"}}, "US", false},
+		{map[interface{}]interface{}{"allow": "DE", "deny": "DE"}, "DE", false},
+		{map[interface{}]interface{}{"deny": "XX"}, "US", true},
+		{map[interface{}]interface{}{"deny": "XX"}, "", true},
+		{map[interface{}]interface{}{"unknown": "deny"}, "", false},
+		{map[interface{}]interface{}{"unknown": "allow", "allow": "DE"}, "", true},
+	}
+	for idx, c := range cases {
+		if allowed := parseFilter(c.conf, nil).allows(c.country); allowed != c.allowed {
+			t.Errorf("Case %d: %s allowed=%v, %v expected", idx, c.country, allowed, c.allowed)
+		}
+	}
+	base := parseFilter(map[interface{}]interface{}{"motd": "motd", "kick": "kick"}, nil)
+	f := parseFilter(map[interface{}]interface{}{"kick": "upstream"}, base)
+	if f.message(1) != "motd" || f.message(2) != "upstream" {
+		t.Errorf("Messages %q, %q found, base motd and own kick expected", f.message(1), f.message(2))
+	}
+	t.Log("Ok, filters decide as expected.")
+}
+
+func TestDecisionCache(t *testing.T) {
+	defer func() {
+		if r := recover(); r != nil {
+			t.Fatalf("Recovered from panic: %s", r)
+			return
+		}
+	}()
+	// Without database, all clients are unknown.
+	deny := parseFilter(map[interface{}]interface{}{"unknown": "deny"}, nil)
+	allow := parseFilter(map[interface{}]interface{}{"unknown": "allow"}, nil)
+	ip := net.ParseIP("198.51.100.7")
+	lock.Lock()
+	cache = make(map[string]*entry)
+	ttl = time.Minute
+	lock.Unlock()
+	if allowed, _ := decide(ip, deny); allowed {
+		t.Fatal("Unknown client allowed by deny filter")
+	}
+	deny.unknown = true
+	if allowed, _ := decide(ip, deny); allowed {
+		t.Error("Cached decision of filter not used")
+	}
+	if allowed, _ := decide(ip, allow); !allowed {
+		t.Error("Decision of another filter used")
+	}
+	lock.Lock()
+	if len(cache) != 1 || len(cache[ip.String()].decisions) != 2 {
+		t.Errorf("%d entries found in cache, 1 entry with 2 decisions expected", len(cache))
+	}
+	cache[ip.String()].expire = time.Now().Add(-time.Second)
+	lock.Unlock()
+	if allowed, _ := decide(ip, deny); !allowed {
+		t.Error("Expired decision used")
+	}
+	t.Log("Ok, decisions are cached by filter until expired.")
+}
+
+func TestSharedServer(t *testing.T) {
+	defer func() {
+		if r := recover(); r != nil {
+			t.Fatalf("Recovered from panic: %s", r)
+			return
+		}
+	}()
+	eu := &minegate.Upstream{Name: "eu", Server: "10.0.0.5:25565", Extras: map[string]interface{}{
+		"geofilter": map[interface{}]interface{}{"unknown": "deny"},
+	}}
+	world := &minegate.Upstream{Name: "world", Server: "10.0.0.5:25565"}
+	if f := filterOf(world); f != nil {
+		t.Errorf("Filter %+v found for upstream without geofilter", f)
+	}
+	if f := filterOf(eu); f == nil || f.allows("") {
+		t.Error("Filter of eu upstream not applied, it shares server with world")
+	}
+	t.Log("Ok, upstreams sharing a server have their own filters.")
+}
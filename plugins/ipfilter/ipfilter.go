@@ -0,0 +1,177 @@
+package ipfilter
+
+import (
+	"github.com/jackyyf/MineGate-Go/minegate"
+	log "github.com/jackyyf/golog"
+	"net"
+	"path/filepath"
+	"sync"
+)
+
+// Clients are filtered by address with allow and deny lists of IPs and CIDR
+// networks, listed inline or in files (one per line, # starts a comment).
+// Deny wins, and with allow lists, only listed addresses are accepted.
+// IPv4-mapped IPv6 addresses match IPv4 networks.
+//
+//   ipfilter:
+//     deny: [203.0.113.0/24]
+//     deny_file: blocked.txt
+//
+// Global filter is checked after connection is accepted, blocked connections
+// are closed at once. Upstreams may have their own ipfilter, checked on
+// login, with a kick message:
+//
+//   ipfilter:
+//     allow_file: office.txt
+//     kick: 'Staff only.'
+//
+// Files are reloaded when modified, and with config.
+
+const default_kick = "You are not allowed to join this server."
+
+type filter struct {
+	allow     []*net.IPNet
+	deny      []*net.IPNet
+	allowFile []string
+	denyFile  []string
+	kick      string
+}
+
+var lock sync.Mutex
+var global *filter
+
+var lists = minegate.NewListFiles("ipfilter", func(file string, entries []string) interface{} {
+	return parseList(entries, file)
+})
+
+// Upstream filters, nil if it has none.
+var filters = minegate.NewUpstreamSettings(func(upstream *minegate.Upstream) interface{} {
+	return parseFilter(upstream.Extras["ipfilter"])
+})
+
+func init() {
+	minegate.OnPostLoadConfig(loadConfig, 0)
+	minegate.OnPostAccept(checkAccept, 4)
+	minegate.OnLoginRequest(checkLogin, 4)
+}
+
+func toList(val interface{}) (list []string) {
+	switch val := val.(type) {
+	case []interface{}:
+		for _, item := range val {
+			list = append(list, minegate.ToString(item))
+		}
+	case string:
+		list = []string{val}
+	}
+	return
+}
+
+func parseFilter(val interface{}) (f *filter) {
+	conf, ok := val.(map[interface{}]interface{})
+	if !ok {
+		return nil
+	}
+	f = &filter{kick: default_kick}
+	f.allow = parseList(toList(conf["allow"]), "config")
+	f.deny = parseList(toList(conf["deny"]), "config")
+	for _, file := range toList(conf["allow_file"]) {
+		file, _ = filepath.Abs(file)
+		f.allowFile = append(f.allowFile, file)
+	}
+	for _, file := range toList(conf["deny_file"]) {
+		file, _ = filepath.Abs(file)
+		f.denyFile = append(f.denyFile, file)
+	}
+	if kick := minegate.ToString(conf["kick"]); kick != "" {
+		f.kick = kick
+	}
+	return
+}
+
+// parseList parses addresses and networks, invalid ones are skipped.
+func parseList(list []string, source string) (nets []*net.IPNet) {
+	for _, entry := range list {
+		parsed, err := minegate.ParseCIDRList([]string{entry})
+		if err != nil {
+			log.Errorf("[ipfilter] invalid address in %s: %s", source, err.Error())
+			continue
+		}
+		nets = append(nets, parsed...)
+	}
+	return
+}
+
+func (f *filter) files() []string {
+	if f == nil {
+		return nil
+	}
+	return append(append([]string{}, f.allowFile...), f.denyFile...)
+}
+
+func matches(ip net.IP, nets []*net.IPNet, list []string) bool {
+	if minegate.InNetworks(ip, nets) {
+		return true
+	}
+	for _, file := range list {
+		listed, _ := lists.Get(file).([]*net.IPNet)
+		if minegate.InNetworks(ip, listed) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *filter) allows(ip net.IP) bool {
+	if matches(ip, f.deny, f.denyFile) {
+		return false
+	}
+	if len(f.allow) == 0 && len(f.allowFile) == 0 {
+		return true
+	}
+	return matches(ip, f.allow, f.allowFile)
+}
+
+func loadConfig() {
+	val, err := minegate.GetExtraConf("ipfilter")
+	var f *filter
+	if err == nil {
+		f = parseFilter(val)
+	}
+	files := f.files()
+	for _, parsed := range filters.Load() {
+		files = append(files, parsed.(*filter).files()...)
+	}
+	// Files no longer used are not watched.
+	lists.Load(files)
+	lock.Lock()
+	global = f
+	lock.Unlock()
+}
+
+func filterOf(upstream *minegate.Upstream) *filter {
+	return filters.Get(upstream).(*filter)
+}
+
+func checkAccept(pae *minegate.PostAcceptEvent) {
+	lock.Lock()
+	f := global
+	lock.Unlock()
+	if f == nil || pae.Rejected() {
+		return
+	}
+	if !f.allows(pae.RemoteAddr.IP) {
+		pae.Warnf("[ipfilter] connection blocked.")
+		pae.Reject()
+	}
+}
+
+func checkLogin(lre *minegate.LoginRequestEvent) {
+	if lre.Rejected() {
+		return
+	}
+	if f := filterOf(lre.Upstream); f != nil && !f.allows(lre.RemoteAddr.IP) {
+		lre.Warnf("[ipfilter] login blocked by %s.", lre.Upstream.Server)
+		lre.Reason(f.kick)
+	}
+}
@@ -0,0 +1,80 @@
+package ipfilter
+
+import (
+	"github.com/jackyyf/MineGate-Go/minegate"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAllows(t *testing.T) {
+	defer func() {
+		if r := recover(); r != nil {
+			t.Fatalf("Recovered from panic: %s", r)
+			return
+		}
+	}()
+	dir, err := ioutil.TempDir("", "ipfilter")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "blocked.txt")
+	err = ioutil.WriteFile(file, []byte("# blocked\n203.0.113.0/24\n2001:db8:bad::1 # single\n"), 0644)
+	if err != nil {
+		t.Fatalf("Unable to write %s: %s", file, err.Error())
+	}
+	cases := []struct {
+		conf    map[interface{}]interface{}
+		ip      string
+		allowed bool
+	}{
+		{map[interface{}]interface{}{}, "198.51.100.1", true},
+		{map[interface{}]interface{}{"deny": "198.51.100.0/24"}, "198.51.100.1", false},
+		{map[interface{}]interface{}{"deny": "198.51.100.0/24"}, "::ffff:198.51.100.1", false},
+		{map[interface{}]interface{}{"deny": "198.51.100.1"}, "198.51.100.2", true},
+		{map[interface{}]interface{}{"allow": "10.0.0.0/8"}, "::ffff:10.1.2.3", true},
+		{map[interface{}]interface{}{"allow": "10.0.0.0/8"}, "198.51.100.1", false},
+		{map[interface{}]interface{}{"allow": "10.0.0.0/8", "deny": "10.0.0.1"}, "10.0.0.1", false},
+		{map[interface{}]interface{}{"allow": []interface{}{"0.0.0.0/0", "::/0"}, "deny_file": file},
+			"203.0.113.9", false},
+		{map[interface{}]interface{}{"allow": []interface{}{"0.0.0.0/0", "::/0"}, "deny_file": file},
+			"2001:db8:bad::1", false},
+		{map[interface{}]interface{}{"allow": []interface{}{"0.0.0.0/0", "::/0"}, "deny_file": file},
+			"2001:db8:bad::2", true},
+		{map[interface{}]interface{}{"allow_file": file}, "::ffff:203.0.113.9", true},
+		{map[interface{}]interface{}{"allow_file": file}, "198.51.100.1", false},
+		{map[interface{}]interface{}{"allow": "bogus", "deny": "bogus"}, "198.51.100.1", true},
+	}
+	lists.Load([]string{file})
+	defer lists.Load(nil)
+	for idx, c := range cases {
+		if allowed := parseFilter(c.conf).allows(net.ParseIP(c.ip)); allowed != c.allowed {
+			t.Errorf("Case %d: %s allowed=%v, %v expected", idx, c.ip, allowed, c.allowed)
+		}
+	}
+	t.Log("Ok, deny wins and mapped addresses match IPv4 networks.")
+}
+
+func TestSharedServer(t *testing.T) {
+	defer func() {
+		if r := recover(); r != nil {
+			t.Fatalf("Recovered from panic: %s", r)
+			return
+		}
+	}()
+	staff := &minegate.Upstream{Name: "staff", Server: "10.0.0.5:25565", Extras: map[string]interface{}{
+		"ipfilter": map[interface{}]interface{}{"allow": "192.168.0.0/16"},
+	}}
+	play := &minegate.Upstream{Name: "play", Server: "10.0.0.5:25565"}
+	ip := net.ParseIP("8.8.8.8")
+	if f := filterOf(play); f != nil {
+		t.Errorf("Filter %+v found for upstream without ipfilter", f)
+	}
+	if f := filterOf(staff); f == nil || f.allows(ip) {
+		t.Errorf("%s allowed by staff upstream sharing server with play", ip)
+	}
+	t.Log("Ok, upstreams sharing a server have their own filters.")
+}
@@ -0,0 +1,198 @@
+package namefilter
+
+import (
+	"github.com/jackyyf/MineGate-Go/minegate"
+	log "github.com/jackyyf/golog"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Player names logging in to an upstream are checked against its whitelist
+// and blacklist, listed inline or in files (one name per line, # starts a
+// comment). Names are matched case-insensitively, and may have wildcards
+// (* and ?, e.g. Staff_*). Blacklist wins, and with a whitelist, only listed
+// players may join.
+//
+//   namefilter:
+//     whitelist: [Notch]
+//     whitelist_file: whitelist.txt
+//     blacklist_file: blacklist.txt
+//     whitelist_kick: 'You are not whitelisted on this server.'
+//     blacklist_kick: 'You are banned from this server.'
+//
+// Files are reloaded when modified, and with config.
+
+const default_whitelist_kick = "You are not whitelisted on this server."
+const default_blacklist_kick = "You are banned from this server."
+
+type nameList struct {
+	names    map[string]bool
+	patterns []string
+}
+
+type filter struct {
+	whitelist     *nameList
+	blacklist     *nameList
+	whitelistFile []string
+	blacklistFile []string
+	whitelistKick string
+	blacklistKick string
+}
+
+var lists = minegate.NewListFiles("namefilter", func(file string, entries []string) interface{} {
+	return parseNames(entries, file)
+})
+
+// Upstream filters, nil if it has none.
+var filters = minegate.NewUpstreamSettings(func(upstream *minegate.Upstream) interface{} {
+	return parseFilter(upstream.Extras["namefilter"])
+})
+
+func init() {
+	minegate.OnPostLoadConfig(loadConfig, 0)
+	minegate.OnLoginRequest(checkLogin, 6)
+}
+
+func toList(val interface{}) (list []string) {
+	switch val := val.(type) {
+	case []interface{}:
+		for _, item := range val {
+			list = append(list, minegate.ToString(item))
+		}
+	case string:
+		list = []string{val}
+	}
+	return
+}
+
+// parseNames parses names and patterns, invalid patterns are skipped.
+func parseNames(entries []string, source string) (list *nameList) {
+	list = &nameList{names: make(map[string]bool)}
+	for _, entry := range entries {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+		if !strings.ContainsAny(entry, "*?[") {
+			list.names[entry] = true
+			continue
+		}
+		if _, err := path.Match(entry, ""); err != nil {
+			log.Errorf("[namefilter] invalid pattern %s in %s", entry, source)
+			continue
+		}
+		list.patterns = append(list.patterns, entry)
+	}
+	return
+}
+
+func (list *nameList) empty() bool {
+	return list == nil || len(list.names) == 0 && len(list.patterns) == 0
+}
+
+// Name should be in lower case.
+func (list *nameList) contains(name string) bool {
+	if list == nil {
+		return false
+	}
+	if list.names[name] {
+		return true
+	}
+	for _, pattern := range list.patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func parseFilter(val interface{}) (f *filter) {
+	conf, ok := val.(map[interface{}]interface{})
+	if !ok {
+		return nil
+	}
+	f = &filter{
+		whitelist:     parseNames(toList(conf["whitelist"]), "config"),
+		blacklist:     parseNames(toList(conf["blacklist"]), "config"),
+		whitelistKick: default_whitelist_kick,
+		blacklistKick: default_blacklist_kick,
+	}
+	for _, file := range toList(conf["whitelist_file"]) {
+		file, _ = filepath.Abs(file)
+		f.whitelistFile = append(f.whitelistFile, file)
+	}
+	for _, file := range toList(conf["blacklist_file"]) {
+		file, _ = filepath.Abs(file)
+		f.blacklistFile = append(f.blacklistFile, file)
+	}
+	if kick := minegate.ToString(conf["whitelist_kick"]); kick != "" {
+		f.whitelistKick = kick
+	}
+	if kick := minegate.ToString(conf["blacklist_kick"]); kick != "" {
+		f.blacklistKick = kick
+	}
+	return
+}
+
+func (f *filter) files() []string {
+	if f == nil {
+		return nil
+	}
+	return append(append([]string{}, f.whitelistFile...), f.blacklistFile...)
+}
+
+func matches(name string, list *nameList, list_files []string) bool {
+	if list.contains(name) {
+		return true
+	}
+	for _, file := range list_files {
+		listed, _ := lists.Get(file).(*nameList)
+		if listed.contains(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// check returns kick message for player name, empty if allowed.
+func (f *filter) check(name string) (kick string) {
+	name = strings.ToLower(name)
+	if matches(name, f.blacklist, f.blacklistFile) {
+		return f.blacklistKick
+	}
+	if f.whitelist.empty() && len(f.whitelistFile) == 0 {
+		return ""
+	}
+	if !matches(name, f.whitelist, f.whitelistFile) {
+		return f.whitelistKick
+	}
+	return ""
+}
+
+func loadConfig() {
+	var files []string
+	for _, parsed := range filters.Load() {
+		files = append(files, parsed.(*filter).files()...)
+	}
+	// Files no longer used are not watched.
+	lists.Load(files)
+}
+
+func filterOf(upstream *minegate.Upstream) *filter {
+	return filters.Get(upstream).(*filter)
+}
+
+func checkLogin(lre *minegate.LoginRequestEvent) {
+	if lre.Rejected() {
+		return
+	}
+	f := filterOf(lre.Upstream)
+	if f == nil {
+		return
+	}
+	if kick := f.check(lre.LoginPacket.Name); kick != "" {
+		lre.Warnf("[namefilter] %s rejected by %s.", lre.LoginPacket.Name, lre.Upstream.Server)
+		lre.Reason(kick)
+	}
+}
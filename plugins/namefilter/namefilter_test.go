@@ -0,0 +1,73 @@
+package namefilter
+
+import (
+	"github.com/jackyyf/MineGate-Go/minegate"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheck(t *testing.T) {
+	defer func() {
+		if r := recover(); r != nil {
+			t.Fatalf("Recovered from panic: %s", r)
+			return
+		}
+	}()
+	dir, err := ioutil.TempDir("", "namefilter")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "whitelist.txt")
+	if err = ioutil.WriteFile(file, []byte("# staff\nNotch\n  jeb_  # dev\nStaff_*\n"), 0644); err != nil {
+		t.Fatalf("Unable to write %s: %s", file, err.Error())
+	}
+	cases := []struct {
+		conf map[interface{}]interface{}
+		name string
+		kick string
+	}{
+		{map[interface{}]interface{}{}, "Steve", ""},
+		{map[interface{}]interface{}{"whitelist": "notch"}, "NOTCH", ""},
+		{map[interface{}]interface{}{"whitelist": "Notch"}, "Steve", default_whitelist_kick},
+		{map[interface{}]interface{}{"blacklist": "griefer?"}, "Griefer1", default_blacklist_kick},
+		{map[interface{}]interface{}{"blacklist": "griefer?"}, "Griefer12", ""},
+		{map[interface{}]interface{}{"whitelist": "*", "blacklist": "Steve"}, "steve", default_blacklist_kick},
+		{map[interface{}]interface{}{"whitelist": "*", "blacklist": "[bad"}, "steve", ""},
+		{map[interface{}]interface{}{"whitelist_file": file}, "Jeb_", ""},
+		{map[interface{}]interface{}{"whitelist_file": file}, "staff_alex", ""},
+		{map[interface{}]interface{}{"whitelist_file": file, "whitelist_kick": "No."}, "Alex", "No."},
+		{map[interface{}]interface{}{"whitelist_file": file, "blacklist": "staff_*"}, "Staff_Alex",
+			default_blacklist_kick},
+	}
+	lists.Load([]string{file})
+	defer lists.Load(nil)
+	for idx, c := range cases {
+		if kick := parseFilter(c.conf).check(c.name); kick != c.kick {
+			t.Errorf("Case %d: %s got %q, %q expected", idx, c.name, kick, c.kick)
+		}
+	}
+	t.Log("Ok, names are matched case-insensitively, blacklist wins.")
+}
+
+func TestSharedServer(t *testing.T) {
+	defer func() {
+		if r := recover(); r != nil {
+			t.Fatalf("Recovered from panic: %s", r)
+			return
+		}
+	}()
+	private := &minegate.Upstream{Name: "private", Server: "10.0.0.5:25565", Extras: map[string]interface{}{
+		"namefilter": map[interface{}]interface{}{"whitelist": "Notch"},
+	}}
+	public := &minegate.Upstream{Name: "public", Server: "10.0.0.5:25565"}
+	if f := filterOf(public); f != nil {
+		t.Errorf("Filter %+v found for upstream without namefilter", f)
+	}
+	if f := filterOf(private); f == nil || f.check("Steve") != default_whitelist_kick {
+		t.Error("Whitelist of private upstream not applied, it shares server with public")
+	}
+	t.Log("Ok, upstreams sharing a server have their own filters.")
+}